@@ -1,18 +1,38 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"nbds3d/internal/nbd"
 )
 
 func main() {
-	addr := flag.String("addr", ":10809", "listen address (host:port)")
-	defaultSize := flag.Uint64("default-size", 1073741824, "default export size in bytes (e.g. 1073741824 = 1GiB)")
+	addr := flag.String("addr", ":10809", "TCP listen address (host:port), empty to disable")
+	socket := flag.String("socket", "", "Unix socket path to listen on")
+	socketMode := flag.String("socket-mode", "0660", "permissions of the Unix socket (octal)")
+	defaultSize := flag.Uint64("default-size", 1073741824, "size in bytes of newly created exports (e.g. 1073741824 = 1GiB)")
 	chunkSize := flag.Uint64("chunk-size", 4194304, "page/chunk size in bytes (e.g. 4194304 = 4MiB)")
+	strictChunkSize := flag.Bool("strict-chunk-size", false, "refuse exports created with a different chunk size instead of using theirs")
+	cacheSize := flag.Uint64("cache-size", 1<<30, "page cache budget across all exports in bytes (0 = unlimited)")
+	cacheStatsInterval := flag.Duration("cache-stats-interval", 5*time.Minute, "how often to log page cache statistics (0 = never)")
+	writebackAge := flag.Duration("writeback-age", 30*time.Second, "write back pages that have been dirty for this long (0 = only on flush)")
+	dirtyHighWatermark := flag.Uint64("dirty-high-watermark", 64<<20, "dirty bytes per export above which all dirty pages are written back (0 = no limit)")
+	dirtyHardLimit := flag.Uint64("dirty-hard-limit", 256<<20, "dirty bytes per export at which writes block until writeback catches up (0 = no limit)")
+	flushWorkers := flag.Int("flush-workers", 8, "pages uploaded in parallel per export when flushing")
+	readAhead := flag.Int("read-ahead", 8, "pages prefetched ahead of sequential reads (0 = disabled)")
 	dataDir := flag.String("data-dir", "./data", "directory to store exports/pages")
+	maxInflight := flag.Int("max-inflight", 16, "maximum concurrently processed requests per connection")
+	maxPayload := flag.Uint64("max-payload", 32<<20, "largest read or write request accepted, in bytes")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for clients to disconnect and exports to be flushed on SIGINT/SIGTERM")
+	description := flag.String("description", "nbds3d export", "export description reported to clients (empty to omit)")
 
 	s3Bucket := flag.String("s3-bucket", "", "S3 bucket name (enables S3 storage when set)")
 	s3Region := flag.String("s3-region", "us-east-1", "S3 region")
@@ -20,18 +40,53 @@ func main() {
 	s3AccessKey := flag.String("s3-access-key", "", "S3 access key ID")
 	s3SecretKey := flag.String("s3-secret-key", "", "S3 secret access key")
 
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (enables NBD_OPT_STARTTLS)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA bundle for verifying client certificates (enables mutual TLS)")
+	tlsRequired := flag.Bool("tls-required", false, "refuse to serve exports until the client has negotiated TLS")
+
+	aclFile := flag.String("acl", "", "JSON file of per-export access rules by client CIDR and certificate subject")
+	readOnly := flag.String("read-only", "", "comma-separated export name patterns (e.g. golden-*) served read-only to every client")
+
 	flag.Parse()
 
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		log.Fatalf("bad -socket-mode %q: %v", *socketMode, err)
+	}
+
 	cfg := nbd.Config{
 		Addr:        *addr,
+		Socket:      *socket,
+		SocketMode:  os.FileMode(mode),
 		DefaultSize: *defaultSize,
 		ChunkSize:   *chunkSize,
 		DataDir:     *dataDir,
+		MaxInflight: *maxInflight,
+		MaxPayload:  *maxPayload,
+		Description: *description,
 		S3Bucket:    *s3Bucket,
 		S3Region:    *s3Region,
 		S3Endpoint:  *s3Endpoint,
 		S3AccessKey: *s3AccessKey,
 		S3SecretKey: *s3SecretKey,
+		TLSCert:     *tlsCert,
+		TLSKey:      *tlsKey,
+		TLSClientCA: *tlsClientCA,
+		TLSRequired: *tlsRequired,
+		ACLFile:     *aclFile,
+
+		StrictChunkSize: *strictChunkSize,
+		ReadOnlyExports: splitList(*readOnly),
+		ShutdownTimeout: *shutdownTimeout,
+
+		CacheSize:          *cacheSize,
+		CacheStatsInterval: *cacheStatsInterval,
+		WritebackAge:       *writebackAge,
+		DirtyHighWatermark: *dirtyHighWatermark,
+		DirtyHardLimit:     *dirtyHardLimit,
+		FlushWorkers:       *flushWorkers,
+		ReadAhead:          *readAhead,
 	}
 
 	if cfg.S3Bucket == "" {
@@ -40,7 +95,21 @@ func main() {
 		}
 	}
 
-	if err := nbd.Run(cfg); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := nbd.Run(ctx, cfg); err != nil {
 		log.Fatalf("server error: %v", err)
 	}
 }
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,183 @@
+package core
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// PageCache is a memory budget shared by the devices of all exports. It
+// keeps their resident pages in one LRU list and, once they take more than
+// the budget, evicts from the cold end: clean pages are dropped, dirty ones
+// are written back first. The budget is soft; requests in flight may exceed
+// it until the next eviction pass.
+//
+// Devices update the cache while holding their own lock, so the cache never
+// calls into a device with its lock held.
+type PageCache struct {
+	limit int64
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[cacheKey]*list.Element
+	used    int64
+
+	hits, misses, evictions, writebacks atomic.Uint64
+}
+
+type cacheKey struct {
+	dev *MemDevice
+	idx uint64
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	size int64
+}
+
+// CacheStats is a snapshot of a PageCache's counters.
+type CacheStats struct {
+	Limit      int64
+	Used       int64
+	Pages      int
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	Writebacks uint64
+}
+
+// NewPageCache returns a cache holding up to limit bytes of pages. A limit
+// of 0 disables eviction; pages are still counted.
+func NewPageCache(limit int64) *PageCache {
+	return &PageCache{
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+func (c *PageCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Limit:      c.limit,
+		Used:       c.used,
+		Pages:      c.lru.Len(),
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Evictions:  c.evictions.Load(),
+		Writebacks: c.writebacks.Load(),
+	}
+}
+
+// add records a page that became resident.
+func (c *PageCache) add(dev *MemDevice, idx uint64, size int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{dev, idx}
+	if el := c.entries[key]; el != nil {
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: int64(size)})
+	c.used += int64(size)
+}
+
+// touch marks a resident page as recently used.
+func (c *PageCache) touch(dev *MemDevice, idx uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el := c.entries[cacheKey{dev, idx}]; el != nil {
+		c.lru.MoveToFront(el)
+	}
+}
+
+// remove forgets a page that is no longer resident.
+func (c *PageCache) remove(dev *MemDevice, idx uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{dev, idx}
+	if el := c.entries[key]; el != nil {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		c.used -= el.Value.(*cacheEntry).size
+	}
+}
+
+func (c *PageCache) hit() {
+	if c != nil {
+		c.hits.Add(1)
+	}
+}
+
+func (c *PageCache) miss() {
+	if c != nil {
+		c.misses.Add(1)
+	}
+}
+
+// shrink evicts pages until the cache is within its budget. It must be
+// called without any device lock held. Each page is tried at most once per
+// call, so pages that keep being dirtied or fail to write back cannot make
+// it spin.
+func (c *PageCache) shrink() {
+	if c == nil || c.limit <= 0 {
+		return
+	}
+	c.mu.Lock()
+	attempts := c.lru.Len()
+	c.mu.Unlock()
+
+	for ; attempts > 0; attempts-- {
+		c.mu.Lock()
+		if c.used <= c.limit || c.lru.Len() == 0 {
+			c.mu.Unlock()
+			return
+		}
+		// Move the victim to the front so concurrent shrinks pick others;
+		// it leaves the list when the device drops the page.
+		el := c.lru.Back()
+		c.lru.MoveToFront(el)
+		key := el.Value.(*cacheEntry).key
+		c.mu.Unlock()
+
+		if key.dev.evictPage(key.idx) {
+			c.evictions.Add(1)
+			continue
+		}
+		if err := key.dev.writeBackPage(key.idx); err != nil {
+			log.Printf("cache: export %q: write back page %d: %v", key.dev.export, key.idx, err)
+			continue
+		}
+		c.writebacks.Add(1)
+		if key.dev.evictPage(key.idx) {
+			c.evictions.Add(1)
+		}
+	}
+}
+
+// dropDevice forgets every page of dev, which is being discarded.
+func (c *PageCache) dropDevice(dev *MemDevice) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if key.dev == dev {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+			c.used -= el.Value.(*cacheEntry).size
+		}
+	}
+}
@@ -3,13 +3,30 @@ package core
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
 	"sync"
+	"time"
 
 	"nbds3d/internal/store"
 )
 
 var (
 	ErrOutOfBounds = errors.New("out of bounds")
+	ErrNotFast     = errors.New("zeroing would not be faster than a write")
+)
+
+// zeroBatchBytes is how much WriteZeroes allocates for NO_HOLE pages before
+// it lets writeback and eviction catch up.
+const zeroBatchBytes = 32 << 20
+
+// Close makes its last attempt to write back dirty pages before the cache is
+// dropped, so it retries with backoff.
+const (
+	closeFlushAttempts = 3
+	closeFlushBackoff  = 200 * time.Millisecond
 )
 
 type MemDevice struct {
@@ -17,11 +34,83 @@ type MemDevice struct {
 	size     int64
 	pageSize uint64
 
+	// mu guards the maps below; the contents of a page are guarded by the
+	// page's own lock, so copies in and out of different pages run in
+	// parallel.
 	mu    sync.RWMutex
-	pages map[uint64][]byte
-	dirty map[uint64]bool
+	pages map[uint64]*page
+	// dirty maps a page to the write sequence number that last modified
+	// it, so a flush only marks a page clean if nothing wrote to it while
+	// the upload was in flight.
+	dirty map[uint64]dirtyPage
+	seq   uint64
+
+	// stored tracks which pages exist in the backend. It is listed once on
+	// first use and kept current as pages are flushed, so block status and
+	// reads of never-written pages don't need a round trip per page.
+	stored       map[uint64]bool
+	storedLoaded bool
+
+	// holes are pages that were trimmed locally and still have to be deleted
+	// from the backend on the next flush. Until then they read as zeroes.
+	holes map[uint64]bool
+
+	// loading holds the pages being fetched from the backend, so that
+	// concurrent misses on a page share one fetch.
+	loading map[uint64]*pageLoad
+
+	// flushLock serialises flushes. Two overlapping ones could otherwise
+	// upload different versions of a page in the wrong order, or delete a
+	// trimmed page from the backend after the other wrote it back. It is a
+	// channel so that waiting for it can be cancelled.
+	flushLock chan struct{}
+	// flushed is closed and replaced whenever a flush finishes, with
+	// flushErr set to its result, so throttled writers can wait for it.
+	flushed  chan struct{}
+	flushErr error
+
+	// unsavedMeta, if set, is the metadata of an export the backend does not
+	// know yet. It is written by the first flush that changes the backend,
+	// so opening a name without writing to it leaves no trace there.
+	unsavedMeta *store.ExportMeta
+
+	// flushWorkers is how many pages a flush uploads at once.
+	flushWorkers int
+
+	// readAhead is how many pages to prefetch ahead of a sequential
+	// reader. raNext is the page following the last read and raIssued the
+	// end of what has been prefetched for the current run.
+	readAhead        int
+	raMu             sync.Mutex
+	raNext, raIssued uint64
+
+	// stop is closed once the device is discarded, ending its background
+	// work.
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	st    store.Store
+	cache *PageCache
+	wb    writeback
+}
+
+// page is a resident page. Its lock is taken before m.mu when both are
+// needed: a write marks the page dirty and copies its data while holding it,
+// so a flush that holds it too sees both or neither.
+type page struct {
+	mu   sync.RWMutex
+	data []byte
+}
 
-	st store.Store
+type pageLoad struct {
+	done  chan struct{}
+	err   error
+	stale bool // trimmed while in flight; the result must not be installed
+}
+
+type dirtyPage struct {
+	seq   uint64
+	since time.Time // when the page last went from clean to dirty
 }
 
 func NewMemDevice(export string, size int64, pageSize uint64, st store.Store) *MemDevice {
@@ -32,14 +121,34 @@ func NewMemDevice(export string, size int64, pageSize uint64, st store.Store) *M
 		export:   export,
 		size:     size,
 		pageSize: pageSize,
-		pages:    make(map[uint64][]byte),
-		dirty:    make(map[uint64]bool),
+		pages:    make(map[uint64]*page),
+		dirty:    make(map[uint64]dirtyPage),
+		stored:   make(map[uint64]bool),
+		holes:    make(map[uint64]bool),
+		loading:  make(map[uint64]*pageLoad),
+		flushed:  make(chan struct{}),
+		stop:     make(chan struct{}),
 		st:       st,
+
+		flushLock:    make(chan struct{}, 1),
+		flushWorkers: 1,
 	}
 }
 
 func (m *MemDevice) Size() int64 { return m.size }
 
+func (m *MemDevice) PageSize() uint64 { return m.pageSize }
+
+// pageCache returns the cache accounting for this device's pages. Without a
+// backend the pages are the only copy of the data, so they are never
+// evicted and not accounted.
+func (m *MemDevice) pageCache() *PageCache {
+	if m.st == nil {
+		return nil
+	}
+	return m.cache
+}
+
 func (m *MemDevice) ReadAt(p []byte, off int64) (int, error) {
 	if off < 0 || off >= m.size {
 		return 0, ErrOutOfBounds
@@ -47,6 +156,11 @@ func (m *MemDevice) ReadAt(p []byte, off int64) (int, error) {
 	if int64(len(p)) > m.size-off {
 		p = p[:m.size-off]
 	}
+	if len(p) > 0 {
+		ps := int64(m.pageSize)
+		m.noteRead(uint64(off/ps), uint64((off+int64(len(p))-1)/ps)+1)
+	}
+	cache := m.pageCache()
 	n := 0
 	for remainingBytes := len(p); remainingBytes > 0; {
 		currentIndex := uint64(off / int64(m.pageSize))
@@ -57,32 +171,30 @@ func (m *MemDevice) ReadAt(p []byte, off int64) (int, error) {
 		}
 
 		m.mu.RLock()
-		page := m.pages[currentIndex]
+		pg := m.pages[currentIndex]
+		if pg != nil {
+			cache.touch(m, currentIndex)
+		}
 		m.mu.RUnlock()
 
-		if page == nil && m.st != nil {
-			buf, err := m.st.ReadPage(context.Background(), store.PageAddress{
-				Export: m.export, Index: currentIndex, Size: m.pageSize,
-			})
-			if err != nil {
+		if pg != nil {
+			cache.hit()
+		} else {
+			var err error
+			if pg, err = m.loadPage(currentIndex, false); err != nil {
 				return n, err
 			}
-			m.mu.Lock()
-			if existing := m.pages[currentIndex]; existing == nil {
-				page = buf
-				m.pages[currentIndex] = page
-			} else {
-				page = existing
-			}
-			m.mu.Unlock()
+			cache.shrink()
 		}
 
-		if page == nil {
+		if pg == nil {
 			for i := 0; i < toCopy; i++ {
 				p[n+i] = 0
 			}
 		} else {
-			copy(p[n:n+toCopy], page[inPage:inPage+toCopy])
+			pg.mu.RLock()
+			copy(p[n:n+toCopy], pg.data[inPage:inPage+toCopy])
+			pg.mu.RUnlock()
 		}
 
 		n += toCopy
@@ -99,7 +211,12 @@ func (m *MemDevice) WriteAt(p []byte, off int64) (int, error) {
 	if int64(len(p)) > m.size-off {
 		p = p[:m.size-off]
 	}
+	if err := m.throttle(); err != nil {
+		return 0, err
+	}
+	cache := m.pageCache()
 	n := 0
+	loaded := false
 	for remainingBytes := len(p); remainingBytes > 0; {
 		currentIndex := uint64(off / int64(m.pageSize))
 		inPage := int(off % int64(m.pageSize))
@@ -108,36 +225,42 @@ func (m *MemDevice) WriteAt(p []byte, off int64) (int, error) {
 			toCopy = remainingBytes
 		}
 
+		// The page has to be resident when it is marked dirty, so a miss
+		// loads it and looks again: it may have been evicted, trimmed or
+		// replaced in between.
 		m.mu.RLock()
-		page := m.pages[currentIndex]
+		pg := m.pages[currentIndex]
 		m.mu.RUnlock()
-
-		if page == nil {
-			if m.st != nil {
-				buf, err := m.st.ReadPage(context.Background(), store.PageAddress{
-					Export: m.export, Index: currentIndex, Size: m.pageSize,
-				})
-				if err != nil {
-					return n, err
-				}
-				page = buf
-			} else {
-				page = make([]byte, int(m.pageSize))
-			}
-			m.mu.Lock()
-			if existing := m.pages[currentIndex]; existing == nil {
-				m.pages[currentIndex] = page
-			} else {
-				page = existing
+		if pg == nil {
+			if _, err := m.loadPage(currentIndex, true); err != nil {
+				return n, err
 			}
-			m.mu.Unlock()
+			loaded = true
+			continue
 		}
-
-		copy(page[inPage:inPage+toCopy], p[n:n+toCopy])
-
+		pg.mu.Lock()
 		m.mu.Lock()
-		m.dirty[currentIndex] = true
+		if m.pages[currentIndex] != pg {
+			m.mu.Unlock()
+			pg.mu.Unlock()
+			continue
+		}
+		if !loaded {
+			cache.hit()
+		}
+		cache.touch(m, currentIndex)
+		m.markDirtyLocked(currentIndex)
+		over := m.overHighWatermarkLocked()
 		m.mu.Unlock()
+		copy(pg.data[inPage:inPage+toCopy], p[n:n+toCopy])
+		pg.mu.Unlock()
+		if over {
+			m.kickWriteback()
+		}
+		if loaded {
+			cache.shrink()
+			loaded = false
+		}
 
 		n += toCopy
 		off += int64(toCopy)
@@ -146,8 +269,106 @@ func (m *MemDevice) WriteAt(p []byte, off int64) (int, error) {
 	return n, nil
 }
 
+// loadPage makes page idx resident and returns it. However many callers
+// miss on the page at once, it is fetched from the backend only once. A page
+// known to read as zeroes is created if create is set and otherwise returned
+// as nil. The page may be evicted again as soon as loadPage returns, so
+// callers that modify it must look it up again under the lock; callers
+// should shrink the cache once done with it.
+func (m *MemDevice) loadPage(idx uint64, create bool) (*page, error) {
+	cache := m.pageCache()
+	for {
+		m.mu.Lock()
+		if pg := m.pages[idx]; pg != nil {
+			m.mu.Unlock()
+			return pg, nil
+		}
+		if l := m.loading[idx]; l != nil {
+			m.mu.Unlock()
+			<-l.done
+			if l.err != nil {
+				return nil, l.err
+			}
+			continue
+		}
+		if m.st == nil || m.absentLocked(idx) {
+			var pg *page
+			if create {
+				pg = &page{data: make([]byte, int(m.pageSize))}
+				m.pages[idx] = pg
+				cache.add(m, idx, len(pg.data))
+			}
+			m.mu.Unlock()
+			return pg, nil
+		}
+		l := &pageLoad{done: make(chan struct{})}
+		m.loading[idx] = l
+		m.mu.Unlock()
+
+		cache.miss()
+		buf, err := m.st.ReadPage(context.Background(), store.PageAddress{
+			Export: m.export, Index: idx, Size: m.pageSize,
+		})
+
+		var pg *page
+		m.mu.Lock()
+		delete(m.loading, idx)
+		l.err = err
+		// Zeroing with NO_HOLE may have installed a page in the meantime.
+		if err == nil {
+			pg = &page{data: buf}
+			if !l.stale && m.pages[idx] == nil {
+				m.pages[idx] = pg
+				cache.add(m, idx, len(buf))
+			}
+		}
+		close(l.done)
+		m.mu.Unlock()
+		return pg, err
+	}
+}
+
+// Close writes back every dirty page. If that still fails after retries the
+// error is returned and the pages stay dirty, so the device must not be
+// dropped.
 func (m *MemDevice) Close() error {
-	return nil
+	return m.CloseWithContext(context.Background())
+}
+
+// CloseWithContext is Close, giving up once ctx is done.
+func (m *MemDevice) CloseWithContext(ctx context.Context) error {
+	var err error
+	backoff := closeFlushBackoff
+	for attempt := 1; attempt <= closeFlushAttempts; attempt++ {
+		if err = m.FlushWithContext(ctx); err == nil {
+			return nil
+		}
+		log.Printf("memdev: export %q: flush on close failed (attempt %d/%d): %v",
+			m.export, attempt, closeFlushAttempts, err)
+		if attempt == closeFlushAttempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("flush on close: %w", err)
+}
+
+// stopBackground ends the device's background writeback and read-ahead.
+func (m *MemDevice) stopBackground() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+func (m *MemDevice) stopped() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
+	}
 }
 
 func (m *MemDevice) Flush() error {
@@ -155,43 +376,459 @@ func (m *MemDevice) Flush() error {
 }
 
 func (m *MemDevice) FlushWithContext(ctx context.Context) error {
+	return m.flushPages(ctx, 0, math.MaxUint64, time.Time{})
+}
+
+// FlushRange persists just the pages overlapping [off, off+length), which is
+// all a FUA request needs.
+func (m *MemDevice) FlushRange(off, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	if off < 0 || off >= m.size {
+		return ErrOutOfBounds
+	}
+	end := off + length
+	if end > m.size {
+		end = m.size
+	}
+	ps := int64(m.pageSize)
+	return m.flushPages(context.Background(), uint64(off/ps), uint64((end+ps-1)/ps), time.Time{})
+}
+
+// flushPages writes back dirty pages and deletes trimmed pages whose index
+// falls in [first, last). If dirtyBefore is set, only pages dirty since
+// before then are written back.
+func (m *MemDevice) flushPages(ctx context.Context, first, last uint64, dirtyBefore time.Time) (err error) {
+	select {
+	case m.flushLock <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-m.flushLock }()
+	defer func() {
+		m.mu.Lock()
+		m.flushErr = err
+		close(m.flushed)
+		m.flushed = make(chan struct{})
+		m.mu.Unlock()
+	}()
+
+	inRange := func(idx uint64) bool { return idx >= first && idx < last }
+	due := func(d dirtyPage) bool { return dirtyBefore.IsZero() || d.since.Before(dirtyBefore) }
+
 	if m.st == nil {
 		m.mu.Lock()
-		for k := range m.dirty {
-			delete(m.dirty, k)
+		for k, d := range m.dirty {
+			if inRange(k) && due(d) {
+				delete(m.dirty, k)
+			}
+		}
+		for k := range m.holes {
+			if inRange(k) {
+				delete(m.holes, k)
+			}
 		}
 		m.mu.Unlock()
 		return nil
 	}
 
-	type item struct {
-		idx  uint64
-		data []byte
-	}
-	var batch []item
+	var batch []flushItem
+	var trimmed []uint64
 
 	m.mu.RLock()
-	for idx := range m.dirty {
-		if pg := m.pages[idx]; pg != nil {
-			cp := make([]byte, len(pg))
-			copy(cp, pg)
-			batch = append(batch, item{idx: idx, data: cp})
+	for idx, d := range m.dirty {
+		if inRange(idx) && due(d) {
+			batch = append(batch, flushItem{idx: idx})
+		}
+	}
+	for idx := range m.holes {
+		if inRange(idx) {
+			trimmed = append(trimmed, idx)
 		}
 	}
 	m.mu.RUnlock()
+	sort.Slice(batch, func(i, j int) bool { return batch[i].idx < batch[j].idx })
 
-	for _, it := range batch {
-		addr := store.PageAddress{Export: m.export, Index: it.idx, Size: m.pageSize}
-		if err := m.st.WritePage(ctx, addr, it.data); err != nil {
-			return err
+	// The metadata goes first, so the backend never holds pages of an export
+	// without knowing their chunk size.
+	if m.unsavedMeta != nil && (len(batch) > 0 || len(trimmed) > 0) {
+		if err := m.st.WriteMeta(ctx, m.export, m.unsavedMeta); err != nil {
+			return fmt.Errorf("write metadata: %w", err)
 		}
+		m.unsavedMeta = nil
 	}
 
+	// Pages that made it are clean even if others failed; those stay dirty
+	// for the next flush.
+	errs := m.uploadPages(ctx, batch)
+	var failed []error
+	canceled := 0
 	m.mu.Lock()
-	for _, it := range batch {
-		delete(m.dirty, it.idx)
+	for i, it := range batch {
+		switch {
+		case errs[i] == nil && it.skipped:
+			// Trimmed since the snapshot; nothing was written.
+		case errs[i] == nil:
+			if m.dirty[it.idx].seq == it.seq {
+				delete(m.dirty, it.idx)
+			}
+			m.stored[it.idx] = true
+		case ctx.Err() != nil && errors.Is(errs[i], ctx.Err()):
+			canceled++
+		default:
+			failed = append(failed, fmt.Errorf("page %d: %w", it.idx, errs[i]))
+		}
 	}
 	m.mu.Unlock()
+	if canceled > 0 {
+		failed = append(failed, fmt.Errorf("%d pages not written: %w", canceled, ctx.Err()))
+	}
+	if len(failed) > 0 {
+		return errors.Join(failed...)
+	}
+
+	if len(trimmed) > 0 {
+		if err := m.st.DeletePages(ctx, m.export, trimmed); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		for _, idx := range trimmed {
+			// A write since the snapshot turned this back into data.
+			if m.holes[idx] {
+				delete(m.holes, idx)
+				delete(m.stored, idx)
+			}
+		}
+		m.mu.Unlock()
+	}
 
 	return m.st.FlushExport(ctx, m.export)
 }
+
+type flushItem struct {
+	idx     uint64
+	seq     uint64 // version uploaded
+	skipped bool   // no longer dirty by the time its turn came
+}
+
+// uploadPages writes batch to the backend, up to flushWorkers pages at a
+// time, and returns the error for each page, nil for those written or
+// skipped. Each page is copied just before its upload, so no more than
+// flushWorkers copies exist at once. Once ctx is done no further uploads are
+// started.
+func (m *MemDevice) uploadPages(ctx context.Context, batch []flushItem) []error {
+	errs := make([]error, len(batch))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < max(1, min(m.flushWorkers, len(batch))); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				it := &batch[i]
+				data, seq := m.snapshotPage(it.idx)
+				if data == nil {
+					it.skipped = true
+					continue
+				}
+				it.seq = seq
+				addr := store.PageAddress{Export: m.export, Index: it.idx, Size: m.pageSize}
+				errs[i] = m.st.WritePage(ctx, addr, data)
+			}
+		}()
+	}
+	for i := range batch {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	return errs
+}
+
+// snapshotPage copies page idx if it is dirty and returns the copy along
+// with the write sequence number it reflects, or nil if the page is clean.
+func (m *MemDevice) snapshotPage(idx uint64) ([]byte, uint64) {
+	for {
+		m.mu.RLock()
+		pg := m.pages[idx]
+		m.mu.RUnlock()
+		if pg == nil {
+			return nil, 0
+		}
+
+		pg.mu.RLock()
+		m.mu.RLock()
+		d, dirty := m.dirty[idx]
+		current := m.pages[idx] == pg
+		m.mu.RUnlock()
+		var data []byte
+		if current && dirty {
+			data = make([]byte, len(pg.data))
+			copy(data, pg.data)
+		}
+		pg.mu.RUnlock()
+		// Replaced meanwhile, by zeroing with NO_HOLE: look again.
+		if current {
+			return data, d.seq
+		}
+	}
+}
+
+// BlockStatus describes [off, off+length) as a list of data and hole
+// extents at page granularity. A page counts as data if it is dirty or
+// present in the backend; pages that were only ever read back as zeroes are
+// holes.
+func (m *MemDevice) BlockStatus(off, length int64) ([]Extent, error) {
+	if off < 0 || off >= m.size {
+		return nil, ErrOutOfBounds
+	}
+	if length > m.size-off {
+		length = m.size - off
+	}
+	if err := m.loadStored(context.Background()); err != nil {
+		return nil, err
+	}
+
+	var extents []Extent
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for end := off + length; off < end; {
+		currentIndex := uint64(off / int64(m.pageSize))
+		next := int64(currentIndex+1) * int64(m.pageSize)
+		if next > end {
+			next = end
+		}
+
+		hole := !m.allocatedLocked(currentIndex)
+		if n := len(extents); n > 0 && extents[n-1].Hole == hole {
+			extents[n-1].Length += next - off
+		} else {
+			extents = append(extents, Extent{Length: next - off, Hole: hole})
+		}
+		off = next
+	}
+	return extents, nil
+}
+
+func (m *MemDevice) allocatedLocked(idx uint64) bool {
+	if m.holes[idx] {
+		return false
+	}
+	if _, dirty := m.dirty[idx]; dirty || m.stored[idx] {
+		return true
+	}
+	return m.st == nil && m.pages[idx] != nil
+}
+
+// absentLocked reports whether a non-resident page is known to read as
+// zeroes, so fetching it from the backend can be skipped.
+func (m *MemDevice) absentLocked(idx uint64) bool {
+	return m.holes[idx] || (m.storedLoaded && !m.stored[idx])
+}
+
+// Trim discards the pages fully covered by [off, off+length). They are
+// dropped from memory at once and deleted from the backend on the next
+// flush. Partially covered pages are left alone, which TRIM permits.
+func (m *MemDevice) Trim(off, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	if off < 0 || off >= m.size {
+		return ErrOutOfBounds
+	}
+	first, last := m.coveredPages(off, length)
+	return m.punch(first, last)
+}
+
+// punch discards pages [first, last). The backend's page list is loaded
+// first, so that only pages that are actually there get deleted.
+func (m *MemDevice) punch(first, last uint64) error {
+	if err := m.loadStored(context.Background()); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.punchLocked(first, last)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemDevice) punchLocked(first, last uint64) {
+	for idx := first; idx < last; idx++ {
+		// Only pages that exist in the backend, or are dirty and so may be
+		// on their way there, need a tombstone.
+		if _, dirty := m.dirty[idx]; m.st != nil && (dirty || m.stored[idx]) {
+			m.holes[idx] = true
+		}
+		if l := m.loading[idx]; l != nil {
+			l.stale = true
+		}
+		if m.pages[idx] != nil {
+			m.pageCache().remove(m, idx)
+			delete(m.pages, idx)
+		}
+		delete(m.dirty, idx)
+	}
+}
+
+// WriteZeroes zeroes [off, off+length). Whole pages become holes unless
+// noHole is set, in which case they are replaced by dirty zero pages;
+// partial pages are zeroed in place. With fast set it fails with ErrNotFast
+// instead of fetching a partial page from the backend.
+func (m *MemDevice) WriteZeroes(off, length int64, noHole, fast bool) error {
+	if length == 0 {
+		return nil
+	}
+	if off < 0 || off >= m.size {
+		return ErrOutOfBounds
+	}
+	end := off + length
+	if end > m.size {
+		end = m.size
+	}
+	first, last := m.coveredPages(off, length)
+	ps := int64(m.pageSize)
+
+	headEnd := int64(first) * ps
+	if headEnd > end {
+		headEnd = end
+	}
+	tailStart := int64(last) * ps
+	if tailStart < headEnd {
+		tailStart = headEnd
+	}
+
+	if fast {
+		m.mu.RLock()
+		slow := (off < headEnd && m.needsFetchLocked(uint64(off/ps))) ||
+			(tailStart < end && m.needsFetchLocked(uint64(tailStart/ps)))
+		m.mu.RUnlock()
+		if slow {
+			return ErrNotFast
+		}
+	}
+
+	if off < headEnd {
+		if _, err := m.WriteAt(make([]byte, headEnd-off), off); err != nil {
+			return err
+		}
+	}
+	if tailStart < end {
+		if _, err := m.WriteAt(make([]byte, end-tailStart), tailStart); err != nil {
+			return err
+		}
+	}
+
+	if !noHole {
+		return m.punch(first, last)
+	}
+
+	// The zero pages are real allocations, so they are added a batch at a
+	// time for the dirty limits and the cache budget to keep up.
+	cache := m.pageCache()
+	batch := max(1, uint64(zeroBatchBytes)/m.pageSize)
+	for idx := first; idx < last; {
+		if err := m.throttle(); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		for stop := min(last, idx+batch); idx < stop; idx++ {
+			m.pages[idx] = &page{data: make([]byte, int(m.pageSize))}
+			cache.add(m, idx, int(m.pageSize))
+			m.markDirtyLocked(idx)
+		}
+		over := m.overHighWatermarkLocked()
+		m.mu.Unlock()
+		if over {
+			m.kickWriteback()
+		}
+		cache.shrink()
+	}
+	return nil
+}
+
+// evictPage drops page idx from memory unless it is dirty. It reports
+// whether the page is no longer resident.
+func (m *MemDevice) evictPage(idx uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, dirty := m.dirty[idx]; dirty {
+		return false
+	}
+	if m.pages[idx] != nil {
+		m.pageCache().remove(m, idx)
+		delete(m.pages, idx)
+	}
+	return true
+}
+
+// writeBackPage persists page idx so it can be evicted.
+func (m *MemDevice) writeBackPage(idx uint64) error {
+	return m.flushPages(context.Background(), idx, idx+1, time.Time{})
+}
+
+func (m *MemDevice) markDirtyLocked(idx uint64) {
+	m.seq++
+	d, dirty := m.dirty[idx]
+	if !dirty {
+		d.since = time.Now()
+	}
+	d.seq = m.seq
+	m.dirty[idx] = d
+	delete(m.holes, idx)
+}
+
+// needsFetchLocked reports whether touching page idx would have to read it
+// from the backend first.
+func (m *MemDevice) needsFetchLocked(idx uint64) bool {
+	return m.st != nil && m.pages[idx] == nil && !m.absentLocked(idx)
+}
+
+// coveredPages returns the range [first, last) of pages lying entirely
+// inside [off, off+length). The short final page of an export counts as
+// covered when the range runs to the end of the device.
+func (m *MemDevice) coveredPages(off, length int64) (uint64, uint64) {
+	end := off + length
+	if end > m.size {
+		end = m.size
+	}
+	ps := int64(m.pageSize)
+	first := (off + ps - 1) / ps
+	last := end / ps
+	if end == m.size {
+		last = (end + ps - 1) / ps
+	}
+	if last < first {
+		last = first
+	}
+	return uint64(first), uint64(last)
+}
+
+// loadStored lists the export's pages from the backend the first time it is
+// needed. The listing is merged rather than assigned so that pages flushed
+// while it was in flight are not forgotten.
+func (m *MemDevice) loadStored(ctx context.Context) error {
+	m.mu.RLock()
+	loaded := m.storedLoaded
+	m.mu.RUnlock()
+	if loaded || m.st == nil {
+		return nil
+	}
+
+	pages, err := m.st.ListPages(ctx, m.export)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	for _, idx := range pages {
+		m.stored[idx] = true
+	}
+	m.storedLoaded = true
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"nbds3d/internal/store"
+)
+
+const testPageSize = 4096
+
+// TestConcurrentOpsMatchModel runs reads, writes, trims, zeroing, flushes and
+// prefetches from several goroutines against one device whose cache holds
+// only a few pages, so that loads, eviction, writeback and read-ahead all
+// interleave. Each goroutine owns a byte range that does not start or end on
+// a page boundary, so neighbours share pages, and checks what it reads
+// against its own model of that range.
+func TestConcurrentOpsMatchModel(t *testing.T) {
+	const (
+		workers    = 8
+		regionSize = 5*testPageSize + 1234
+		ops        = 300
+	)
+	size := int64(workers*regionSize+testPageSize-1) / testPageSize * testPageSize
+	st := store.NewFSStore(t.TempDir())
+	ctx := context.Background()
+
+	reg := NewRegistry(st, testPageSize, size)
+	reg.Cache = NewPageCache(8 * testPageSize)
+	reg.Writeback = Writeback{MaxAge: 5 * time.Millisecond, HighWatermark: 6 * testPageSize, HardLimit: 12 * testPageSize}
+	reg.FlushWorkers = 4
+	reg.ReadAhead = 4
+	dev, err := reg.Open(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models := make([][]byte, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		models[w] = make([]byte, regionSize)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			model := models[w]
+			base := int64(w * regionSize)
+			rng := rand.New(rand.NewPCG(uint64(w), 1))
+			for i := 0; i < ops; i++ {
+				o := rng.Int64N(regionSize)
+				n := 1 + rng.Int64N(min(regionSize-o, 3*testPageSize))
+				off := base + o
+
+				var err error
+				switch op := rng.IntN(10); {
+				case op < 4:
+					p := make([]byte, n)
+					for j := range p {
+						p[j] = byte(rng.IntN(255) + 1)
+					}
+					_, err = dev.WriteAt(p, off)
+					copy(model[o:], p)
+				case op < 6:
+					got := make([]byte, n)
+					if _, err = dev.ReadAt(got, off); err == nil && !bytes.Equal(got, model[o:o+n]) {
+						t.Errorf("worker %d: read [%d, %d) does not match", w, off, off+n)
+					}
+				case op == 6:
+					err = dev.Trim(off, n)
+					first := (off + testPageSize - 1) / testPageSize * testPageSize
+					last := (off + n) / testPageSize * testPageSize
+					for p := first; p < last; p++ {
+						model[p-base] = 0
+					}
+				case op == 7:
+					err = dev.WriteZeroes(off, n, rng.IntN(2) == 0, false)
+					clear(model[o : o+n])
+				case op == 8:
+					err = dev.Flush()
+				default:
+					err = dev.Prefetch(off, n)
+				}
+				if err != nil {
+					t.Errorf("worker %d: op %d: %v", w, i, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	want := bytes.Join(models, nil)
+	want = append(want, make([]byte, size-int64(len(want)))...)
+	got := make([]byte, size)
+	if _, err := dev.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("device content does not match model")
+	}
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything must have reached the store.
+	reopened, err := NewRegistry(st, testPageSize, size).Open(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if _, err := reopened.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("stored content does not match model")
+	}
+}
+
+// peakStore records how much the cache held whenever a page was written
+// back.
+type peakStore struct {
+	store.Store
+	cache *PageCache
+
+	mu   sync.Mutex
+	peak int64
+}
+
+func (s *peakStore) WritePage(ctx context.Context, addr store.PageAddress, data []byte) error {
+	used := s.cache.Stats().Used
+	s.mu.Lock()
+	s.peak = max(s.peak, used)
+	s.mu.Unlock()
+	return s.Store.WritePage(ctx, addr, data)
+}
+
+// TestWriteZeroesNoHoleWithinBudget zeroes a range far larger than the cache
+// with NO_HOLE and checks the zero pages were written back as they were
+// added rather than all allocated first.
+func TestWriteZeroesNoHoleWithinBudget(t *testing.T) {
+	const (
+		pageSize = 64 << 10
+		limit    = 1 << 20
+		length   = 256 << 20
+	)
+	cache := NewPageCache(limit)
+	st := &peakStore{Store: store.NewFSStore(t.TempDir()), cache: cache}
+	reg := NewRegistry(st, pageSize, length)
+	reg.Cache = cache
+	dev, err := reg.Open(context.Background(), "z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	if err := dev.WriteZeroes(0, length, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if st.peak == 0 || st.peak > limit+zeroBatchBytes {
+		t.Fatalf("cache held up to %d bytes, want at most %d", st.peak, limit+zeroBatchBytes)
+	}
+}
+
+// deleteCountStore counts the pages deleted from the backend.
+type deleteCountStore struct {
+	store.Store
+	deleted int
+}
+
+func (s *deleteCountStore) DeletePages(ctx context.Context, export string, indices []uint64) error {
+	s.deleted += len(indices)
+	return s.Store.DeletePages(ctx, export, indices)
+}
+
+// TestTrimDeletesOnlyStoredPages trims a large range of an export with just
+// a couple of pages in the backend and checks that only those get deleted,
+// also when the range is trimmed again later.
+func TestTrimDeletesOnlyStoredPages(t *testing.T) {
+	const size = 1 << 30
+	st := &deleteCountStore{Store: store.NewFSStore(t.TempDir())}
+	ctx := context.Background()
+	dev, err := NewRegistry(st, testPageSize, size).Open(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	for _, off := range []int64{0, 100 * testPageSize} {
+		if _, err := dev.WriteAt([]byte{1}, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dev.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := dev.Trim(0, size); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.WriteZeroes(0, size, false, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st.deleted != 2 {
+		t.Fatalf("deleted %d pages, want 2", st.deleted)
+	}
+	pages, err := st.ListPages(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 0 {
+		t.Fatalf("pages %v left after trim", pages)
+	}
+}
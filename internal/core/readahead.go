@@ -0,0 +1,101 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// prefetchWorkers bounds how many pages a Prefetch call fetches at once.
+const prefetchWorkers = 8
+
+// Prefetch loads the pages overlapping [off, off+length) into the cache,
+// so that reading them later does not wait for the backend.
+func (m *MemDevice) Prefetch(off, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	if off < 0 || off >= m.size {
+		return ErrOutOfBounds
+	}
+	if m.st == nil {
+		return nil
+	}
+	end := off + length
+	if end > m.size {
+		end = m.size
+	}
+	ps := int64(m.pageSize)
+	first, last := uint64(off/ps), uint64((end+ps-1)/ps)
+
+	errs := make([]error, last-first)
+	work := make(chan uint64)
+	var wg sync.WaitGroup
+	for w := 0; w < min(prefetchWorkers, len(errs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range work {
+				_, errs[idx-first] = m.loadPage(idx, false)
+				m.pageCache().shrink()
+			}
+		}()
+	}
+	for idx := first; idx < last; idx++ {
+		work <- idx
+	}
+	close(work)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// noteRead records a read of pages [first, last). If it continues the
+// previous read, the pages up to readAhead past it are fetched in the
+// background; each sequential read extends that window by what it consumed.
+func (m *MemDevice) noteRead(first, last uint64) {
+	if m.readAhead <= 0 || m.st == nil {
+		return
+	}
+	m.raMu.Lock()
+	// Small reads may stay within the page the previous one ended in.
+	sequential := first == m.raNext || first+1 == m.raNext
+	m.raNext = last
+	if !sequential {
+		m.raIssued = last
+		m.raMu.Unlock()
+		return
+	}
+	start := max(last, m.raIssued)
+	end := min(last+uint64(m.readAhead), m.numPages())
+	if start >= end {
+		m.raMu.Unlock()
+		return
+	}
+	m.raIssued = end
+	m.raMu.Unlock()
+
+	for idx := start; idx < end; idx++ {
+		go m.prefetchPage(idx)
+	}
+}
+
+func (m *MemDevice) prefetchPage(idx uint64) {
+	if m.stopped() {
+		return
+	}
+	if _, err := m.loadPage(idx, false); err != nil {
+		log.Printf("memdev: export %q: read-ahead of page %d: %v", m.export, idx, err)
+		return
+	}
+	// A device discarded meanwhile has already been dropped from the
+	// cache; the page must not linger there.
+	if m.stopped() {
+		m.evictPage(idx)
+		return
+	}
+	m.pageCache().shrink()
+}
+
+func (m *MemDevice) numPages() uint64 {
+	return uint64((m.size + int64(m.pageSize) - 1) / int64(m.pageSize))
+}
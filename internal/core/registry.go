@@ -0,0 +1,292 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"nbds3d/internal/store"
+)
+
+// ErrPageSizeMismatch is returned in strict mode for an export whose stored
+// chunk size differs from the configured one.
+var ErrPageSizeMismatch = errors.New("export chunk size differs from configured chunk size")
+
+// ErrNoMetadata is returned in strict mode for an export that has pages but
+// no metadata, so the chunk size they were written with is unknown.
+var ErrNoMetadata = errors.New("export has pages but no metadata")
+
+// Registry hands out one shared MemDevice per export name, so every
+// connection to an export sees the same page cache and a flush on any of
+// them covers writes made through all of them. Devices are reference counted
+// and closed, which flushes them, when the last connection lets go.
+type Registry struct {
+	st          store.Store
+	pageSize    uint64
+	defaultSize int64 // size of newly created exports
+
+	// StrictPageSize refuses exports created with a different chunk size
+	// instead of serving them with the chunk size they were created with.
+	StrictPageSize bool
+	// Cache, if set, bounds the memory used by the pages of all devices.
+	Cache *PageCache
+	// Writeback configures the background flusher of each device.
+	Writeback Writeback
+	// FlushWorkers is how many pages a device uploads in parallel when
+	// flushing; values below 1 mean one at a time.
+	FlushWorkers int
+	// ReadAhead is how many pages a device prefetches ahead of sequential
+	// reads; 0 disables read-ahead.
+	ReadAhead int
+
+	mu      sync.Mutex
+	devices map[string]*registryEntry
+}
+
+type registryEntry struct {
+	dev  *MemDevice
+	meta store.ExportMeta
+	refs int
+}
+
+func NewRegistry(st store.Store, pageSize uint64, defaultSize int64) *Registry {
+	return &Registry{
+		st:          st,
+		pageSize:    pageSize,
+		defaultSize: defaultSize,
+		devices:     make(map[string]*registryEntry),
+	}
+}
+
+// Open returns a handle to the named export's device, creating the device
+// on first use with the size and chunk size recorded in the export's
+// metadata. An export without metadata is new: it gets the defaults, and
+// they are recorded with its first write so later opens agree on them even
+// if the configuration changes. Opening a name, or only reading it, leaves
+// the backend untouched. Closing the handle drops the reference.
+func (r *Registry) Open(ctx context.Context, name string) (Device, error) {
+	if dev := r.acquire(name); dev != nil {
+		return dev, nil
+	}
+
+	meta, err := r.meta(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	unsaved := meta == nil
+	if unsaved {
+		var stored int
+		if meta, stored, err = r.newMeta(ctx, name); err != nil {
+			return nil, err
+		}
+		if stored > 0 {
+			log.Printf("registry: WARNING: export %q has %d pages but no metadata; serving it with chunk size %d and size %d, which are recorded on its first write. "+
+				"If its pages were written with another chunk size they will read back scrambled: fix chunk_size in its meta.json before writing to it.",
+				name, stored, meta.ChunkSize, meta.Size)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Another connection may have created the device in the meantime.
+	e := r.devices[name]
+	if e == nil {
+		if meta.ChunkSize != r.pageSize {
+			log.Printf("registry: export %q uses chunk size %d (configured %d)", name, meta.ChunkSize, r.pageSize)
+		}
+		e = &registryEntry{dev: NewMemDevice(name, meta.Size, meta.ChunkSize, r.st), meta: *meta}
+		e.dev.cache = r.Cache
+		e.dev.flushWorkers = max(1, r.FlushWorkers)
+		e.dev.readAhead = r.ReadAhead
+		if unsaved {
+			e.dev.unsavedMeta = meta
+		}
+		e.dev.startWriteback(r.Writeback)
+		r.devices[name] = e
+	}
+	e.refs++
+	return &sharedDevice{MemDevice: e.dev, reg: r, name: name}, nil
+}
+
+// Lookup returns the metadata of the named export, or what it would be
+// created with, without opening it.
+func (r *Registry) Lookup(ctx context.Context, name string) (store.ExportMeta, error) {
+	r.mu.Lock()
+	e := r.devices[name]
+	r.mu.Unlock()
+	if e != nil {
+		return e.meta, nil
+	}
+
+	meta, err := r.meta(ctx, name)
+	if err != nil {
+		return store.ExportMeta{}, err
+	}
+	if meta == nil {
+		if meta, _, err = r.newMeta(ctx, name); err != nil {
+			return store.ExportMeta{}, err
+		}
+	}
+	return *meta, nil
+}
+
+// newMeta returns the metadata to create an export without any with, and
+// how many pages it already has. Exports from before metadata was recorded
+// may have pages written with another chunk size than the configured one,
+// which strict mode refuses to assume. Otherwise the size is at least
+// enough to cover every stored page.
+func (r *Registry) newMeta(ctx context.Context, name string) (*store.ExportMeta, int, error) {
+	meta := &store.ExportMeta{Size: r.defaultSize, ChunkSize: r.pageSize, Created: time.Now().UTC()}
+	if r.st == nil {
+		return meta, 0, nil
+	}
+	pages, err := r.st.ListPages(ctx, name)
+	if err != nil {
+		return nil, 0, fmt.Errorf("export %q: list pages: %w", name, err)
+	}
+	if len(pages) == 0 {
+		return meta, 0, nil
+	}
+	if r.StrictPageSize {
+		return nil, 0, fmt.Errorf("export %q: %w (%d pages)", name, ErrNoMetadata, len(pages))
+	}
+	if end := int64(slices.Max(pages)+1) * int64(r.pageSize); end > meta.Size {
+		meta.Size = end
+	}
+	return meta, len(pages), nil
+}
+
+// acquire takes a reference to an already open device.
+func (r *Registry) acquire(name string) Device {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.devices[name]
+	if e == nil {
+		return nil
+	}
+	e.refs++
+	return &sharedDevice{MemDevice: e.dev, reg: r, name: name}
+}
+
+func (r *Registry) meta(ctx context.Context, name string) (*store.ExportMeta, error) {
+	if r.st == nil {
+		return nil, nil
+	}
+	meta, err := r.st.ReadMeta(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("export %q: read metadata: %w", name, err)
+	}
+	if meta == nil {
+		return nil, nil
+	}
+
+	// Pages are stored by index, so reading them with another chunk size
+	// would scramble the export: it keeps the one it was created with.
+	if meta.ChunkSize == 0 {
+		meta.ChunkSize = r.pageSize
+	}
+	if meta.ChunkSize != r.pageSize {
+		if r.StrictPageSize {
+			return nil, fmt.Errorf("export %q: %w (%d, configured %d)", name, ErrPageSizeMismatch, meta.ChunkSize, r.pageSize)
+		}
+	}
+	return meta, nil
+}
+
+// Exports lists the exports known to the backend plus any that are open
+// but have not been flushed yet.
+func (r *Registry) Exports(ctx context.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	if r.st != nil {
+		names, err := r.st.ListExports(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			seen[name] = true
+		}
+	}
+
+	r.mu.Lock()
+	for name := range r.devices {
+		seen[name] = true
+	}
+	r.mu.Unlock()
+
+	exports := make([]string, 0, len(seen))
+	for name := range seen {
+		exports = append(exports, name)
+	}
+	sort.Strings(exports)
+	return exports, nil
+}
+
+// Close flushes every device still registered, giving up once ctx is done:
+// normally none are left once all connections are gone, except those whose
+// flush on release failed.
+func (r *Registry) Close(ctx context.Context) error {
+	r.mu.Lock()
+	entries := make(map[string]*registryEntry, len(r.devices))
+	for name, e := range r.devices {
+		entries[name] = e
+	}
+	r.mu.Unlock()
+
+	var errs []error
+	for name, e := range entries {
+		if err := e.dev.CloseWithContext(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("export %q: %w", name, err))
+		}
+		e.dev.stopBackground()
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Registry) release(name string) error {
+	r.mu.Lock()
+	e := r.devices[name]
+	if e == nil {
+		r.mu.Unlock()
+		return nil
+	}
+	e.refs--
+	if e.refs > 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	r.mu.Unlock()
+
+	// Flush outside the lock. The entry stays registered meanwhile, so a
+	// connection reopening the export shares this cache instead of reading
+	// pages from the store that are still being written back. If the flush
+	// fails the device is kept, dirty pages and all, for a later attempt.
+	err := e.dev.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil && e.refs == 0 && r.devices[name] == e {
+		delete(r.devices, name)
+		e.dev.stopBackground()
+		r.Cache.dropDevice(e.dev)
+	}
+	return err
+}
+
+// sharedDevice is one connection's reference to a registry device.
+type sharedDevice struct {
+	*MemDevice
+	reg  *Registry
+	name string
+	once sync.Once
+}
+
+func (d *sharedDevice) Close() error {
+	var err error
+	d.once.Do(func() { err = d.reg.release(d.name) })
+	return err
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"nbds3d/internal/store"
+)
+
+// TestOpenWritesMetadataOnFirstWrite checks that opening and reading an
+// unknown export leaves the backend alone, and that its metadata is
+// recorded once something is written to it.
+func TestOpenWritesMetadataOnFirstWrite(t *testing.T) {
+	st := store.NewFSStore(t.TempDir())
+	ctx := context.Background()
+	reg := NewRegistry(st, testPageSize, 1<<20)
+
+	dev, err := reg.Open(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dev.ReadAt(make([]byte, testPageSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := st.ListExports(ctx); err != nil || len(names) != 0 {
+		t.Fatalf("exports after read-only open: %v, %v", names, err)
+	}
+
+	if dev, err = reg.Open(ctx, "t"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dev.WriteAt([]byte{1}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := st.ReadMeta(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta == nil || meta.Size != 1<<20 || meta.ChunkSize != testPageSize {
+		t.Fatalf("metadata after write: %+v", meta)
+	}
+}
@@ -4,6 +4,20 @@ type Device interface {
 	ReadAt(p []byte, off int64) (int, error)
 	WriteAt(p []byte, off int64) (int, error)
 	Flush() error
+	FlushRange(off, length int64) error
 	Size() int64
+	PageSize() uint64
 	Close() error
+	BlockStatus(off, length int64) ([]Extent, error)
+	Trim(off, length int64) error
+	WriteZeroes(off, length int64, noHole, fast bool) error
+	// Prefetch loads a range into the cache ahead of reads.
+	Prefetch(off, length int64) error
+}
+
+// Extent is a run of a device that is either backed by data or a hole that
+// reads as zeroes.
+type Extent struct {
+	Length int64
+	Hole   bool
 }
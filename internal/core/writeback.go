@@ -0,0 +1,145 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// minWritebackInterval bounds how often the background flusher looks for
+// pages that are due, however short the maximum age.
+const minWritebackInterval = 10 * time.Millisecond
+
+// Writeback configures background writeback of a device's dirty pages, so
+// that data reaches the backend even if clients rarely flush. Zero values
+// disable the respective trigger.
+type Writeback struct {
+	// MaxAge is how long a page may stay dirty before it is written back.
+	MaxAge time.Duration
+	// HighWatermark is the amount of dirty data, in bytes, above which all
+	// dirty pages of the device are written back.
+	HighWatermark int64
+	// HardLimit is the amount of dirty data, in bytes, at which writes
+	// block until writeback has brought it back down.
+	HardLimit int64
+}
+
+func (wb Writeback) enabled() bool {
+	return wb.MaxAge > 0 || wb.HighWatermark > 0 || wb.HardLimit > 0
+}
+
+// writeback is a device's background flusher.
+type writeback struct {
+	Writeback
+	kick chan struct{}
+}
+
+// startWriteback runs the background flusher for the device until
+// stopBackground is called. It must be called before the device is used.
+func (m *MemDevice) startWriteback(cfg Writeback) {
+	if !cfg.enabled() {
+		return
+	}
+	m.wb = writeback{
+		Writeback: cfg,
+		kick:      make(chan struct{}, 1),
+	}
+	go m.writebackLoop()
+}
+
+func (m *MemDevice) writebackLoop() {
+	var tick <-chan time.Time
+	if m.wb.MaxAge > 0 {
+		t := time.NewTicker(max(m.wb.MaxAge/2, minWritebackInterval))
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-tick:
+		case <-m.wb.kick:
+		}
+		if err := m.writeBackDue(); err != nil {
+			log.Printf("memdev: export %q: background writeback: %v", m.export, err)
+		}
+	}
+}
+
+// writeBackDue writes back every dirty page if there is too much dirty data,
+// otherwise the pages that have been dirty for longer than the maximum age
+// along with pending trims.
+func (m *MemDevice) writeBackDue() error {
+	var before time.Time
+	m.mu.RLock()
+	all := m.overHighWatermarkLocked() || m.overHardLimitLocked()
+	if !all {
+		if m.wb.MaxAge <= 0 {
+			m.mu.RUnlock()
+			return nil
+		}
+		before = time.Now().Add(-m.wb.MaxAge)
+	}
+	due := len(m.holes) > 0
+	for _, d := range m.dirty {
+		if due || all || d.since.Before(before) {
+			due = true
+			break
+		}
+	}
+	m.mu.RUnlock()
+	if !due {
+		return nil
+	}
+	return m.flushPages(context.Background(), 0, math.MaxUint64, before)
+}
+
+// kickWriteback wakes the background flusher, if there is one.
+func (m *MemDevice) kickWriteback() {
+	select {
+	case m.wb.kick <- struct{}{}:
+	default:
+	}
+}
+
+// throttle blocks a writer while the device holds as much dirty data as the
+// hard limit allows, until flushes bring it back below. It fails if a flush
+// it waited for failed and the limit is still exceeded.
+func (m *MemDevice) throttle() error {
+	if m.wb.HardLimit <= 0 {
+		return nil
+	}
+	for waited := false; ; waited = true {
+		m.mu.RLock()
+		over := m.overHardLimitLocked()
+		flushed, err := m.flushed, m.flushErr
+		m.mu.RUnlock()
+		if !over {
+			return nil
+		}
+		if waited && err != nil {
+			return fmt.Errorf("writeback: %w", err)
+		}
+		m.kickWriteback()
+		select {
+		case <-flushed:
+		case <-m.stop:
+			return nil
+		}
+	}
+}
+
+func (m *MemDevice) dirtyBytesLocked() int64 {
+	return int64(len(m.dirty)) * int64(m.pageSize)
+}
+
+func (m *MemDevice) overHighWatermarkLocked() bool {
+	return m.wb.HighWatermark > 0 && m.dirtyBytesLocked() > m.wb.HighWatermark
+}
+
+func (m *MemDevice) overHardLimitLocked() bool {
+	return m.wb.HardLimit > 0 && m.dirtyBytesLocked() >= m.wb.HardLimit
+}
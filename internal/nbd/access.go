@@ -0,0 +1,149 @@
+package nbd
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+)
+
+// Access is what a client may do with an export.
+type Access int
+
+const (
+	AccessDenied Access = iota
+	AccessReadOnly
+	AccessReadWrite
+)
+
+// ACL decides, per export, which clients may connect and whether they get
+// read-write or read-only access. Rules are tried in order and the first one
+// matching both the export and the client wins; a client that matches no rule
+// is denied. A nil ACL lets everyone in read-write.
+type ACL struct {
+	Rules []ACLRule `json:"rules"`
+}
+
+// ACLRule matches clients by source address and, over TLS, by the subject
+// of their verified certificate. Empty match lists match anything.
+type ACLRule struct {
+	Export   string   `json:"export"`   // path.Match pattern, "" matches every export
+	CIDRs    []string `json:"cidrs"`    // source networks, e.g. "10.0.0.0/8"
+	Subjects []string `json:"subjects"` // certificate subject ("CN=a,O=b") or common name
+	Access   string   `json:"access"`   // "rw", "ro" or "deny"
+
+	nets   []*net.IPNet
+	access Access
+}
+
+// LoadACL reads a JSON rule file such as:
+//
+//	{"rules": [
+//	  {"export": "golden-*", "access": "ro"},
+//	  {"export": "vm-*", "cidrs": ["10.1.0.0/16"], "access": "rw"}
+//	]}
+func LoadACL(file string) (*ACL, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var acl ACL
+	if err := json.Unmarshal(raw, &acl); err != nil {
+		return nil, fmt.Errorf("acl %s: %w", file, err)
+	}
+
+	for i := range acl.Rules {
+		r := &acl.Rules[i]
+		if _, err := path.Match(r.Export, ""); err != nil {
+			return nil, fmt.Errorf("acl rule %d: bad export pattern %q", i, r.Export)
+		}
+		for _, cidr := range r.CIDRs {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("acl rule %d: %w", i, err)
+			}
+			r.nets = append(r.nets, ipnet)
+		}
+		switch r.Access {
+		case "rw":
+			r.access = AccessReadWrite
+		case "ro":
+			r.access = AccessReadOnly
+		case "deny":
+			r.access = AccessDenied
+		default:
+			return nil, fmt.Errorf("acl rule %d: access must be rw, ro or deny, not %q", i, r.Access)
+		}
+	}
+	return &acl, nil
+}
+
+// Check returns the access the client at addr, with TLS state ts (nil if the
+// connection is not encrypted), has to export.
+func (a *ACL) Check(export string, addr net.Addr, ts *tls.ConnectionState) Access {
+	if a == nil {
+		return AccessReadWrite
+	}
+	for i := range a.Rules {
+		if r := &a.Rules[i]; r.matches(export, addr, ts) {
+			return r.access
+		}
+	}
+	return AccessDenied
+}
+
+// readOnlyExport reports whether name matches one of cfg.ReadOnlyExports.
+// Those exports are read-only for every client, whatever the ACL grants.
+func readOnlyExport(cfg Config, name string) bool {
+	for _, pattern := range cfg.ReadOnlyExports {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ACLRule) matches(export string, addr net.Addr, ts *tls.ConnectionState) bool {
+	if r.Export != "" {
+		if ok, _ := path.Match(r.Export, export); !ok {
+			return false
+		}
+	}
+
+	if len(r.nets) > 0 {
+		tcp, ok := addr.(*net.TCPAddr)
+		if !ok {
+			return false
+		}
+		found := false
+		for _, n := range r.nets {
+			if n.Contains(tcp.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Subjects) > 0 {
+		if ts == nil || len(ts.VerifiedChains) == 0 {
+			return false
+		}
+		subject := ts.VerifiedChains[0][0].Subject
+		found := false
+		for _, s := range r.Subjects {
+			if s == subject.String() || s == subject.CommonName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
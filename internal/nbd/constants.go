@@ -9,6 +9,8 @@ const (
 	NBD_SIMPLE_REPLY_MAGIC     uint32 = 0x67446698
 	NBD_REQUEST_MAGIC          uint32 = 0x25609513
 	NBD_STRUCTURED_REPLY_MAGIC uint32 = 0x668e33ef
+	NBD_REQUEST_EXT_MAGIC      uint32 = 0x21e41c71
+	NBD_EXTENDED_REPLY_MAGIC   uint32 = 0x6e8a278c
 )
 
 // Handshake flags (server -> client)
@@ -34,6 +36,8 @@ const (
 	NBD_FLAG_SEND_WRITE_ZEROES = 1 << 6
 	NBD_FLAG_SEND_DF           = 1 << 7
 	NBD_FLAG_CAN_MULTI_CONN    = 1 << 8
+	NBD_FLAG_SEND_CACHE        = 1 << 10
+	NBD_FLAG_SEND_FAST_ZERO    = 1 << 11
 )
 
 // Options (client -> server during handshake)
@@ -47,6 +51,7 @@ const (
 	NBD_OPT_STRUCTURED_REPLY  = 8
 	NBD_OPT_LIST_META_CONTEXT = 9
 	NBD_OPT_SET_META_CONTEXT  = 10
+	NBD_OPT_EXTENDED_HEADERS  = 11
 )
 
 // Option replies (server -> client)
@@ -63,6 +68,7 @@ const (
 	NBD_REP_ERR_UNKNOWN         = (1 << 31) + 6
 	NBD_REP_ERR_SHUTDOWN        = (1 << 31) + 7
 	NBD_REP_ERR_BLOCK_SIZE_REQD = (1 << 31) + 8
+	NBD_REP_ERR_TOO_BIG         = (1 << 31) + 9
 )
 
 // Transmission request types
@@ -77,6 +83,39 @@ const (
 	NBD_CMD_BLOCK_STATUS = 7
 )
 
+// Command flags (client -> server, per request)
+const (
+	NBD_CMD_FLAG_FUA         = 1 << 0
+	NBD_CMD_FLAG_NO_HOLE     = 1 << 1
+	NBD_CMD_FLAG_DF          = 1 << 2
+	NBD_CMD_FLAG_REQ_ONE     = 1 << 3
+	NBD_CMD_FLAG_FAST_ZERO   = 1 << 4
+	NBD_CMD_FLAG_PAYLOAD_LEN = 1 << 5
+)
+
+// Structured reply chunk types (server -> client)
+const (
+	NBD_REPLY_TYPE_NONE             = 0
+	NBD_REPLY_TYPE_OFFSET_DATA      = 1
+	NBD_REPLY_TYPE_OFFSET_HOLE      = 2
+	NBD_REPLY_TYPE_BLOCK_STATUS     = 5
+	NBD_REPLY_TYPE_BLOCK_STATUS_EXT = 6
+	NBD_REPLY_TYPE_ERROR            = (1 << 15) + 1
+	NBD_REPLY_TYPE_ERROR_OFFSET     = (1 << 15) + 2
+)
+
+// base:allocation metadata context and its status flags
+const (
+	NBD_META_BASE_ALLOCATION = "base:allocation"
+	NBD_STATE_HOLE           = 1 << 0
+	NBD_STATE_ZERO           = 1 << 1
+)
+
+// Structured reply chunk flags
+const (
+	NBD_REPLY_FLAG_DONE = 1 << 0
+)
+
 // Error codes (simple reply `error` field)
 const (
 	NBD_EPERM     = 1
@@ -3,21 +3,75 @@ package nbd
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/bits"
 	"nbds3d/internal/core"
 	"net"
+	"strings"
+	"time"
 )
 
 const (
-	NBD_INFO_EXPORT = 0
+	NBD_INFO_EXPORT      = 0
+	NBD_INFO_NAME        = 1
+	NBD_INFO_DESCRIPTION = 2
+	NBD_INFO_BLOCK_SIZE  = 3
 )
 
-func ServeConn(c net.Conn, cfg Config, newDev func(name string, size uint64) core.Device) error {
+const tlsHandshakeTimeout = 30 * time.Second
+
+// defaultMaxPayload is the largest read or write we accept, and advertise
+// through NBD_INFO_BLOCK_SIZE, unless Config.MaxPayload says otherwise.
+const defaultMaxPayload = 32 << 20
+
+// maxOptionSize bounds option payloads. The largest legitimate ones carry an
+// export name and a few metadata context queries.
+const maxOptionSize = 64 << 10
+
+// maxNameLength is the protocol's limit on export names.
+const maxNameLength = 4096
+
+// allocationContextID is the id we hand out for base:allocation; it is the
+// only metadata context we serve.
+const allocationContextID = 1
+
+// session carries what was negotiated during the handshake into the
+// transmission phase.
+type session struct {
+	structuredReplies bool
+	extendedHeaders   bool // implies structuredReplies
+	holeSize          uint64
+
+	metaExport        string
+	allocationContext bool
+
+	// tls is set once NBD_OPT_STARTTLS has completed.
+	tls *tls.ConnectionState
+
+	readOnly bool
+
+	// maxPayload is the largest READ or WRITE length accepted.
+	maxPayload uint64
+}
+
+func newSession(cfg Config) *session {
+	return &session{holeSize: cfg.ChunkSize, maxPayload: uint64(maxBlockSize(cfg, cfg.ChunkSize))}
+}
+
+// ServeConn runs the handshake and transmission phases on c. Once ctx is
+// done the server is shutting down: further options are refused with
+// NBD_REP_ERR_SHUTDOWN and requests with NBD_ESHUTDOWN.
+func ServeConn(ctx context.Context, c net.Conn, cfg Config, reg *core.Registry, tlsCfg *tls.Config, acl *ACL) error {
 	br := bufio.NewReader(c)
 	bw := bufio.NewWriter(c)
-	defer c.Close()
-	defer bw.Flush()
+	// c, br and bw are replaced if the connection is upgraded to TLS.
+	defer func() { c.Close() }()
+	defer func() { bw.Flush() }()
 
 	if err := writeU64(bw, NBDMAGIC); err != nil {
 		return fmt.Errorf("writeU64 NBDMAGIC: %w", err)
@@ -32,12 +86,15 @@ func ServeConn(c net.Conn, cfg Config, newDev func(name string, size uint64) cor
 		return err
 	}
 
-	if _, err := readU32(br); err != nil {
+	clientFlags, err := readU32(br)
+	if err != nil {
 		return fmt.Errorf("client flags: %w", err)
 	}
+	if clientFlags&^(NBD_FLAG_C_FIXED_NEWSTYLE|NBD_FLAG_C_NO_ZEROES) != 0 {
+		return fmt.Errorf("unknown client flags: 0x%x", clientFlags)
+	}
 
-	var exportName string
-	exportSize := cfg.DefaultSize
+	sess := newSession(cfg)
 
 	for {
 		magic, err := readU64(br)
@@ -56,11 +113,54 @@ func ServeConn(c net.Conn, cfg Config, newDev func(name string, size uint64) cor
 		if err != nil {
 			return fmt.Errorf("readU32 olen: %w", err)
 		}
+		if olen > maxOptionSize {
+			// Skip the payload rather than buffer it. NBD_OPT_EXPORT_NAME
+			// cannot be answered with an error, so that one ends the session.
+			if opt == NBD_OPT_EXPORT_NAME {
+				return fmt.Errorf("export name option of %d bytes exceeds limit", olen)
+			}
+			if _, err := io.CopyN(io.Discard, br, int64(olen)); err != nil {
+				return fmt.Errorf("discard option: %w", err)
+			}
+			if err := writeReply(bw, opt, NBD_REP_ERR_TOO_BIG, []byte("option too large")); err != nil {
+				return err
+			}
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
 		data, err := readN(br, int(olen))
 		if err != nil {
 			return fmt.Errorf("readN data: %w", err)
 		}
 
+		if ctx.Err() != nil && opt != NBD_OPT_ABORT {
+			if opt == NBD_OPT_EXPORT_NAME {
+				return errors.New("export requested during shutdown")
+			}
+			if err := writeReply(bw, opt, NBD_REP_ERR_SHUTDOWN, []byte("server shutting down")); err != nil {
+				return err
+			}
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if cfg.TLSRequired && sess.tls == nil && opt != NBD_OPT_STARTTLS && opt != NBD_OPT_ABORT {
+			if opt == NBD_OPT_EXPORT_NAME {
+				return errors.New("export requested before TLS was negotiated")
+			}
+			if err := writeReply(bw, opt, NBD_REP_ERR_TLS_REQD, []byte("TLS required")); err != nil {
+				return err
+			}
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
+
 		switch opt {
 		case NBD_OPT_ABORT:
 			if err := writeReply(bw, opt, NBD_REP_ACK, nil); err != nil {
@@ -69,44 +169,142 @@ func ServeConn(c net.Conn, cfg Config, newDev func(name string, size uint64) cor
 			_ = bw.Flush()
 			return nil
 
-		case NBD_OPT_GO:
-			if len(data) < 6 {
-				_ = writeReply(bw, opt, NBD_REP_ERR_INVALID, []byte("short GO"))
-				continue
+		case NBD_OPT_STARTTLS:
+			var reject string
+			switch {
+			case tlsCfg == nil:
+				reject = "TLS not configured"
+			case sess.tls != nil:
+				reject = "TLS already negotiated"
+			case len(data) != 0:
+				reject = "unexpected payload"
 			}
-			rd := bytes.NewReader(data)
-			nameLen, _ := readU32(rd)
-			if int(nameLen)+6 > len(data) {
-				_ = writeReply(bw, opt, NBD_REP_ERR_INVALID, []byte("bad nameLen"))
+			if reject != "" {
+				repType := uint32(NBD_REP_ERR_INVALID)
+				if tlsCfg == nil {
+					repType = NBD_REP_ERR_UNSUP
+				}
+				if err := writeReply(bw, opt, repType, []byte(reject)); err != nil {
+					return err
+				}
+				if err := bw.Flush(); err != nil {
+					return err
+				}
 				continue
 			}
-			name := make([]byte, nameLen)
-			if _, err := io.ReadFull(rd, name); err != nil {
-				_ = writeReply(bw, opt, NBD_REP_ERR_INVALID, []byte("name read"))
-				continue
+
+			if err := writeReply(bw, opt, NBD_REP_ACK, nil); err != nil {
+				return err
+			}
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			if br.Buffered() != 0 {
+				return errors.New("starttls: client sent data before the TLS handshake")
 			}
-			exportName = string(name)
 
-			infoCount, _ := readU16(rd)
-			if _, err := io.CopyN(io.Discard, rd, int64(infoCount*2)); err != nil && err != io.EOF {
-				_ = writeReply(bw, opt, NBD_REP_ERR_INVALID, []byte("info read"))
-				continue
+			tc := tls.Server(c, tlsCfg)
+			hctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+			err := tc.HandshakeContext(hctx)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("tls handshake: %w", err)
 			}
+			c = tc
+			br = bufio.NewReader(c)
+			bw = bufio.NewWriter(c)
+
+			// Nothing negotiated in the clear carries over.
+			state := tc.ConnectionState()
+			sess = newSession(cfg)
+			sess.tls = &state
 
-			txFlags := uint16(NBD_FLAG_HAS_FLAGS | NBD_FLAG_SEND_FLUSH)
-			if err := writeReply(bw, opt, NBD_REP_INFO, infoExportPayload(exportSize, txFlags)); err != nil {
+		case NBD_OPT_LIST:
+			allowed := func(name string) bool {
+				return acl.Check(name, c.RemoteAddr(), sess.tls) != AccessDenied
+			}
+			if err := handleList(bw, data, reg, allowed); err != nil {
 				return err
 			}
-			if err := writeReply(bw, opt, NBD_REP_ACK, nil); err != nil {
+
+		case NBD_OPT_STRUCTURED_REPLY:
+			if len(data) != 0 {
+				if err := writeReply(bw, opt, NBD_REP_ERR_INVALID, []byte("unexpected payload")); err != nil {
+					return err
+				}
+			} else {
+				sess.structuredReplies = true
+				if err := writeReply(bw, opt, NBD_REP_ACK, nil); err != nil {
+					return err
+				}
+			}
+			if err := bw.Flush(); err != nil {
 				return err
 			}
+
+		case NBD_OPT_EXTENDED_HEADERS:
+			if len(data) != 0 {
+				if err := writeReply(bw, opt, NBD_REP_ERR_INVALID, []byte("unexpected payload")); err != nil {
+					return err
+				}
+			} else {
+				sess.extendedHeaders = true
+				sess.structuredReplies = true
+				if err := writeReply(bw, opt, NBD_REP_ACK, nil); err != nil {
+					return err
+				}
+			}
 			if err := bw.Flush(); err != nil {
 				return err
 			}
 
-			dev := newDev(exportName, exportSize)
-			defer dev.Close()
-			return transmit(br, bw, dev)
+		case NBD_OPT_LIST_META_CONTEXT, NBD_OPT_SET_META_CONTEXT:
+			if err := handleMetaContext(bw, opt, data, sess); err != nil {
+				return err
+			}
+
+		case NBD_OPT_INFO, NBD_OPT_GO:
+			name, dev, err := handleInfo(ctx, bw, opt, data, cfg, reg, sess, acl, c.RemoteAddr())
+			if err != nil {
+				return err
+			}
+			if dev == nil {
+				continue
+			}
+
+			return serveExport(ctx, br, bw, cfg, sess, name, dev)
+
+		case NBD_OPT_EXPORT_NAME:
+			// The old-style option has no error reply: on failure the only
+			// thing we may do is drop the connection.
+			name := string(data)
+			if err := checkExportName(name); err != nil {
+				return err
+			}
+			access := acl.Check(name, c.RemoteAddr(), sess.tls)
+			if access == AccessDenied {
+				return fmt.Errorf("export %q: access denied", name)
+			}
+			sess.readOnly = access == AccessReadOnly || readOnlyExport(cfg, name)
+			dev, err := reg.Open(ctx, name)
+			if err != nil {
+				return err
+			}
+			err = writeU64(bw, uint64(dev.Size()))
+			if err == nil {
+				err = writeU16(bw, transmissionFlags(sess))
+			}
+			if err == nil && clientFlags&NBD_FLAG_C_NO_ZEROES == 0 {
+				_, err = bw.Write(make([]byte, 124))
+			}
+			if err == nil {
+				err = bw.Flush()
+			}
+			if err != nil {
+				dev.Close()
+				return err
+			}
+			return serveExport(ctx, br, bw, cfg, sess, name, dev)
 
 		default:
 			if err := writeReply(bw, opt, NBD_REP_ERR_UNSUP, nil); err != nil {
@@ -119,6 +317,322 @@ func ServeConn(c net.Conn, cfg Config, newDev func(name string, size uint64) cor
 	}
 }
 
+// serveExport runs the transmission phase on the named export's device until
+// the client disconnects, however it does so. Closing the device then
+// flushes it once no other connection uses the export, so writes the client
+// never flushed are not lost.
+func serveExport(ctx context.Context, br *bufio.Reader, bw *bufio.Writer, cfg Config, sess *session, name string, dev core.Device) error {
+	if name != sess.metaExport {
+		sess.allocationContext = false
+	}
+	// The export may have been created with another chunk size.
+	sess.holeSize = dev.PageSize()
+	sess.maxPayload = uint64(maxBlockSize(cfg, dev.PageSize()))
+
+	err := transmit(ctx, br, bw, dev, sess, cfg.MaxInflight)
+	if cerr := dev.Close(); cerr != nil {
+		log.Printf("nbd: export %q: %v", name, cerr)
+	}
+	return err
+}
+
+// handleInfo answers NBD_OPT_INFO and NBD_OPT_GO: NBD_INFO_EXPORT is always
+// sent, followed by whichever of name, description and block size the client
+// asked for. For NBD_OPT_GO the export is opened before anything is sent, so
+// a failure to open it can still be reported, and the device is returned.
+// It is nil for NBD_OPT_INFO and for requests that were rejected.
+func handleInfo(ctx context.Context, w *bufio.Writer, opt uint32, data []byte, cfg Config, reg *core.Registry, sess *session, acl *ACL, remote net.Addr) (string, core.Device, error) {
+	name, infos, err := parseInfoRequest(data)
+	if err == nil {
+		err = checkExportName(name)
+	}
+	if err != nil {
+		if err := writeReply(w, opt, NBD_REP_ERR_INVALID, []byte(err.Error())); err != nil {
+			return "", nil, err
+		}
+		return "", nil, w.Flush()
+	}
+
+	access := acl.Check(name, remote, sess.tls)
+	if access == AccessDenied {
+		log.Printf("nbd: %s denied access to export %q", remote, name)
+		if err := writeReply(w, opt, NBD_REP_ERR_POLICY, []byte("access denied")); err != nil {
+			return "", nil, err
+		}
+		return "", nil, w.Flush()
+	}
+	sess.readOnly = access == AccessReadOnly || readOnlyExport(cfg, name)
+
+	var dev core.Device
+	var size int64
+	var chunkSize uint64
+	if opt == NBD_OPT_GO {
+		if dev, err = reg.Open(ctx, name); err == nil {
+			size, chunkSize = dev.Size(), dev.PageSize()
+		}
+	} else {
+		meta, lerr := reg.Lookup(ctx, name)
+		size, chunkSize, err = meta.Size, meta.ChunkSize, lerr
+	}
+	if err != nil {
+		log.Printf("nbd: %v", err)
+		repType, msg := uint32(NBD_REP_ERR_UNKNOWN), "export unavailable"
+		switch {
+		case errors.Is(err, core.ErrPageSizeMismatch):
+			repType, msg = NBD_REP_ERR_POLICY, "export chunk size differs from server chunk size"
+		case errors.Is(err, core.ErrNoMetadata):
+			repType, msg = NBD_REP_ERR_POLICY, "export has no metadata recording its chunk size"
+		}
+		if err := writeReply(w, opt, repType, []byte(msg)); err != nil {
+			return "", nil, err
+		}
+		return "", nil, w.Flush()
+	}
+
+	if err := writeInfo(w, opt, name, infos, cfg, sess, size, chunkSize); err != nil {
+		if dev != nil {
+			dev.Close()
+		}
+		return "", nil, err
+	}
+	return name, dev, nil
+}
+
+func writeInfo(w *bufio.Writer, opt uint32, name string, infos []uint16, cfg Config, sess *session, size int64, chunkSize uint64) error {
+	if err := writeReply(w, opt, NBD_REP_INFO, infoExportPayload(uint64(size), transmissionFlags(sess))); err != nil {
+		return err
+	}
+
+	sent := make(map[uint16]bool)
+	for _, info := range infos {
+		if sent[info] {
+			continue
+		}
+		sent[info] = true
+
+		var b bytes.Buffer
+		_ = writeU16(&b, info)
+		switch info {
+		case NBD_INFO_NAME:
+			b.WriteString(name)
+		case NBD_INFO_DESCRIPTION:
+			if cfg.Description == "" {
+				continue
+			}
+			b.WriteString(cfg.Description)
+		case NBD_INFO_BLOCK_SIZE:
+			_ = writeU32(&b, 1)
+			_ = writeU32(&b, preferredBlockSize(chunkSize))
+			_ = writeU32(&b, maxBlockSize(cfg, chunkSize))
+		default:
+			continue
+		}
+		if err := writeReply(w, opt, NBD_REP_INFO, b.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if err := writeReply(w, opt, NBD_REP_ACK, nil); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func parseInfoRequest(data []byte) (string, []uint16, error) {
+	rd := bytes.NewReader(data)
+	name, err := readString(rd)
+	if err != nil {
+		return "", nil, errors.New("bad export name")
+	}
+	count, err := readU16(rd)
+	if err != nil {
+		return "", nil, errors.New("bad info count")
+	}
+	if rd.Len() != int(count)*2 {
+		return "", nil, errors.New("bad info list")
+	}
+	infos := make([]uint16, count)
+	for i := range infos {
+		infos[i], _ = readU16(rd)
+	}
+	return name, infos, nil
+}
+
+func transmissionFlags(sess *session) uint16 {
+	txFlags := uint16(NBD_FLAG_HAS_FLAGS | NBD_FLAG_SEND_FLUSH | NBD_FLAG_SEND_FUA | NBD_FLAG_SEND_TRIM |
+		NBD_FLAG_SEND_WRITE_ZEROES | NBD_FLAG_SEND_FAST_ZERO | NBD_FLAG_CAN_MULTI_CONN | NBD_FLAG_SEND_CACHE)
+	if sess.structuredReplies {
+		txFlags |= NBD_FLAG_SEND_DF
+	}
+	if sess.readOnly {
+		txFlags |= NBD_FLAG_READ_ONLY
+	}
+	return txFlags
+}
+
+// preferredBlockSize is the page size rounded down to a power of two, as the
+// protocol requires. Aligning to it spares us read-modify-write of pages.
+func preferredBlockSize(pageSize uint64) uint32 {
+	if pageSize == 0 {
+		return 4096
+	}
+	if pageSize > 1<<31 {
+		pageSize = 1 << 31
+	}
+	return uint32(1) << (bits.Len64(pageSize) - 1)
+}
+
+// maxBlockSize is the maximum block size we advertise: the configured
+// payload limit, raised to the preferred block size for chunkSize if that is
+// larger as the protocol requires.
+func maxBlockSize(cfg Config, chunkSize uint64) uint32 {
+	maximum := uint32(cfg.MaxPayload)
+	if maximum == 0 {
+		maximum = defaultMaxPayload
+	}
+	if preferred := preferredBlockSize(chunkSize); preferred > maximum {
+		maximum = preferred
+	}
+	return maximum
+}
+
+// checkExportName rejects names the backends cannot store safely: export
+// names become a directory or key prefix, so they must not contain path
+// separators or be a relative path element.
+func checkExportName(name string) error {
+	switch {
+	case len(name) > maxNameLength:
+		return errors.New("export name too long")
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid export name %q", name)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return fmt.Errorf("invalid export name %q", name)
+	}
+	return nil
+}
+
+// handleList answers NBD_OPT_LIST with one NBD_REP_SERVER per export the
+// client is allowed to open.
+func handleList(w *bufio.Writer, data []byte, reg *core.Registry, allowed func(name string) bool) error {
+	if len(data) != 0 {
+		if err := writeReply(w, NBD_OPT_LIST, NBD_REP_ERR_INVALID, []byte("unexpected payload")); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	exports, err := reg.Exports(context.Background())
+	if err != nil {
+		log.Printf("nbd: list exports: %v", err)
+		if err := writeReply(w, NBD_OPT_LIST, NBD_REP_ERR_UNKNOWN, []byte("cannot list exports")); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	for _, name := range exports {
+		if !allowed(name) {
+			continue
+		}
+		var b bytes.Buffer
+		_ = writeU32(&b, uint32(len(name)))
+		b.WriteString(name)
+		if err := writeReply(w, NBD_OPT_LIST, NBD_REP_SERVER, b.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := writeReply(w, NBD_OPT_LIST, NBD_REP_ACK, nil); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// handleMetaContext answers NBD_OPT_LIST_META_CONTEXT and
+// NBD_OPT_SET_META_CONTEXT. Only base:allocation is available.
+func handleMetaContext(w *bufio.Writer, opt uint32, data []byte, sess *session) error {
+	set := opt == NBD_OPT_SET_META_CONTEXT
+	if set && !sess.structuredReplies {
+		if err := writeReply(w, opt, NBD_REP_ERR_INVALID, []byte("structured replies not negotiated")); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	export, queries, err := parseMetaContextRequest(data)
+	if err != nil {
+		if err := writeReply(w, opt, NBD_REP_ERR_INVALID, []byte(err.Error())); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	// LIST without queries asks for everything; a bare namespace only
+	// matches when listing.
+	match := !set && len(queries) == 0
+	for _, q := range queries {
+		if q == NBD_META_BASE_ALLOCATION || (!set && q == "base:") {
+			match = true
+		}
+	}
+
+	if set {
+		sess.metaExport = export
+		sess.allocationContext = match
+	}
+	if match {
+		var b bytes.Buffer
+		_ = writeU32(&b, allocationContextID)
+		b.WriteString(NBD_META_BASE_ALLOCATION)
+		if err := writeReply(w, opt, NBD_REP_META_CONTEXT, b.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := writeReply(w, opt, NBD_REP_ACK, nil); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func parseMetaContextRequest(data []byte) (string, []string, error) {
+	rd := bytes.NewReader(data)
+	export, err := readString(rd)
+	if err != nil {
+		return "", nil, errors.New("bad export name")
+	}
+	count, err := readU32(rd)
+	if err != nil {
+		return "", nil, errors.New("bad query count")
+	}
+	var queries []string
+	for i := uint32(0); i < count; i++ {
+		q, err := readString(rd)
+		if err != nil {
+			return "", nil, errors.New("bad query")
+		}
+		queries = append(queries, q)
+	}
+	if rd.Len() != 0 {
+		return "", nil, errors.New("trailing data")
+	}
+	return export, queries, nil
+}
+
+// readString reads a 32-bit length-prefixed string from an option payload.
+func readString(rd *bytes.Reader) (string, error) {
+	n, err := readU32(rd)
+	if err != nil {
+		return "", err
+	}
+	if int64(n) > int64(rd.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rd, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 func infoExportPayload(size uint64, txFlags uint16) []byte {
 	var b bytes.Buffer
 	_ = writeU16(&b, NBD_INFO_EXPORT)
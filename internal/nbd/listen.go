@@ -0,0 +1,124 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDsStart = 3
+
+// openListeners returns the sockets to serve on: the ones handed over by
+// systemd if the process was socket activated, otherwise the TCP address
+// and Unix socket from cfg, either of which may be left empty.
+func openListeners(cfg Config) ([]net.Listener, error) {
+	lns, err := systemdListeners()
+	if err != nil || lns != nil {
+		return lns, err
+	}
+
+	if cfg.Addr != "" {
+		ln, err := net.Listen("tcp", cfg.Addr)
+		if err != nil {
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	if cfg.Socket != "" {
+		ln, err := listenUnix(cfg.Socket, cfg.SocketMode)
+		if err != nil {
+			closeListeners(lns)
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	if len(lns) == 0 {
+		return nil, errors.New("no listen address or socket configured")
+	}
+	return lns, nil
+}
+
+// listenUnix listens on a Unix socket at path, replacing a stale socket file
+// left behind by a previous run, and sets its permissions to mode so local
+// clients such as qemu can connect.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("socket %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// systemdListeners returns the listening sockets passed in by systemd
+// (LISTEN_PID/LISTEN_FDS), or nil if the process was not socket activated.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("systemd: bad LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// The sockets are ours; child processes must not pick them up too.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	lns := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// FileListener works on a duplicate, so the original is closed
+		// either way.
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(lns)
+			return nil, fmt.Errorf("systemd: socket %s: %w", name, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+func closeListeners(lns []net.Listener) {
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
+
+func listenerAddrs(lns []net.Listener) string {
+	addrs := make([]string, len(lns))
+	for i, ln := range lns {
+		addrs[i] = ln.Addr().Network() + ":" + ln.Addr().String()
+	}
+	return strings.Join(addrs, ", ")
+}
@@ -0,0 +1,206 @@
+package nbd
+
+import (
+	"bufio"
+
+	"nbds3d/internal/core"
+)
+
+// readChunk is one piece of a structured read reply: either a run of data
+// or a run of zeroes that is sent as a hole.
+type readChunk struct {
+	start, end int
+	hole       bool
+}
+
+// replyFrame identifies the request a chunk answers and how chunk headers
+// are framed on this connection.
+type replyFrame struct {
+	cookie   uint64
+	off      uint64 // request offset, echoed in extended reply headers
+	extended bool
+}
+
+func writeChunkHeader(w *bufio.Writer, fr replyFrame, flags, typ uint16, length uint64) error {
+	magic := uint32(NBD_STRUCTURED_REPLY_MAGIC)
+	if fr.extended {
+		magic = NBD_EXTENDED_REPLY_MAGIC
+	}
+	if err := writeU32(w, magic); err != nil {
+		return err
+	}
+	if err := writeU16(w, flags); err != nil {
+		return err
+	}
+	if err := writeU16(w, typ); err != nil {
+		return err
+	}
+	if err := writeU64(w, fr.cookie); err != nil {
+		return err
+	}
+	if fr.extended {
+		if err := writeU64(w, fr.off); err != nil {
+			return err
+		}
+		return writeU64(w, length)
+	}
+	return writeU32(w, uint32(length))
+}
+
+// writeNoneChunk acknowledges a request that returns no data.
+func writeNoneChunk(w *bufio.Writer, fr replyFrame) error {
+	if err := writeChunkHeader(w, fr, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_NONE, 0); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func writeErrorChunk(w *bufio.Writer, fr replyFrame, errCode uint32, msg string) error {
+	if err := writeChunkHeader(w, fr, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_ERROR, uint64(6+len(msg))); err != nil {
+		return err
+	}
+	if err := writeU32(w, errCode); err != nil {
+		return err
+	}
+	if err := writeU16(w, uint16(len(msg))); err != nil {
+		return err
+	}
+	if _, err := w.WriteString(msg); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// writeStructuredRead sends buf, read from off, as OFFSET_DATA and
+// OFFSET_HOLE chunks. Zero runs are detected at holeSize granularity
+// (aligned to the export, not the request) so that untouched pages go out as
+// a 12-byte hole instead of a page worth of zeroes. When df is set the whole
+// read is sent as a single data chunk, as the client asked us not to fragment.
+func writeStructuredRead(w *bufio.Writer, fr replyFrame, off uint64, buf []byte, holeSize uint64, df bool) error {
+	if len(buf) == 0 {
+		return writeNoneChunk(w, fr)
+	}
+
+	var chunks []readChunk
+	if df || holeSize == 0 {
+		chunks = []readChunk{{start: 0, end: len(buf)}}
+	} else {
+		chunks = splitHoles(off, buf, holeSize)
+	}
+
+	for i, ch := range chunks {
+		var flags uint16
+		if i == len(chunks)-1 {
+			flags = NBD_REPLY_FLAG_DONE
+		}
+		chunkOff := off + uint64(ch.start)
+		size := ch.end - ch.start
+
+		if ch.hole {
+			if err := writeChunkHeader(w, fr, flags, NBD_REPLY_TYPE_OFFSET_HOLE, 12); err != nil {
+				return err
+			}
+			if err := writeU64(w, chunkOff); err != nil {
+				return err
+			}
+			if err := writeU32(w, uint32(size)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := writeChunkHeader(w, fr, flags, NBD_REPLY_TYPE_OFFSET_DATA, uint64(8+size)); err != nil {
+			return err
+		}
+		if err := writeU64(w, chunkOff); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf[ch.start:ch.end]); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// splitHoles partitions buf into alternating data and hole runs, merging
+// neighbouring blocks of the same kind.
+func splitHoles(off uint64, buf []byte, holeSize uint64) []readChunk {
+	var chunks []readChunk
+	for start := 0; start < len(buf); {
+		end := start + int(holeSize-(off+uint64(start))%holeSize)
+		if end > len(buf) {
+			end = len(buf)
+		}
+		hole := isZero(buf[start:end])
+
+		if n := len(chunks); n > 0 && chunks[n-1].hole == hole {
+			chunks[n-1].end = end
+		} else {
+			chunks = append(chunks, readChunk{start: start, end: end, hole: hole})
+		}
+		start = end
+	}
+	return chunks
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeBlockStatus answers NBD_CMD_BLOCK_STATUS for a single metadata context.
+// With reqOne only the first extent is sent. Extended headers use the
+// 64-bit NBD_REPLY_TYPE_BLOCK_STATUS_EXT descriptors.
+func writeBlockStatus(w *bufio.Writer, fr replyFrame, contextID uint32, extents []core.Extent, reqOne bool) error {
+	if reqOne && len(extents) > 1 {
+		extents = extents[:1]
+	}
+
+	if fr.extended {
+		if err := writeChunkHeader(w, fr, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_BLOCK_STATUS_EXT, uint64(8+16*len(extents))); err != nil {
+			return err
+		}
+		if err := writeU32(w, contextID); err != nil {
+			return err
+		}
+		if err := writeU32(w, uint32(len(extents))); err != nil {
+			return err
+		}
+		for _, e := range extents {
+			if err := writeU64(w, uint64(e.Length)); err != nil {
+				return err
+			}
+			if err := writeU64(w, uint64(extentFlags(e))); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}
+
+	if err := writeChunkHeader(w, fr, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_BLOCK_STATUS, uint64(4+8*len(extents))); err != nil {
+		return err
+	}
+	if err := writeU32(w, contextID); err != nil {
+		return err
+	}
+	for _, e := range extents {
+		if err := writeU32(w, uint32(e.Length)); err != nil {
+			return err
+		}
+		if err := writeU32(w, extentFlags(e)); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func extentFlags(e core.Extent) uint32 {
+	if e.Hole {
+		return NBD_STATE_HOLE | NBD_STATE_ZERO
+	}
+	return 0
+}
@@ -0,0 +1,215 @@
+package nbd
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+
+	"nbds3d/internal/core"
+)
+
+const testCookie = uint64(0xdeadbeefcafef00d)
+
+func TestWriteChunkHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		fr   replyFrame
+		want []byte
+	}{
+		{
+			// magic, flags, type, cookie, 32-bit length
+			name: "structured",
+			fr:   replyFrame{cookie: testCookie, off: 4096},
+			want: wire(NBD_STRUCTURED_REPLY_MAGIC, uint16(NBD_REPLY_FLAG_DONE), uint16(NBD_REPLY_TYPE_OFFSET_DATA), testCookie, uint32(1000)),
+		},
+		{
+			// magic, flags, type, cookie, offset, 64-bit length
+			name: "extended",
+			fr:   replyFrame{cookie: testCookie, off: 4096, extended: true},
+			want: wire(NBD_EXTENDED_REPLY_MAGIC, uint16(NBD_REPLY_FLAG_DONE), uint16(NBD_REPLY_TYPE_OFFSET_DATA), testCookie, uint64(4096), uint64(1000)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := bufio.NewWriter(&out)
+			if err := writeChunkHeader(w, tt.fr, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_OFFSET_DATA, 1000); err != nil {
+				t.Fatal(err)
+			}
+			w.Flush()
+			if !bytes.Equal(out.Bytes(), tt.want) {
+				t.Fatalf("got  %x\nwant %x", out.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteBlockStatus(t *testing.T) {
+	const contextID = uint32(7)
+	hole := NBD_STATE_HOLE | NBD_STATE_ZERO
+	extents := []core.Extent{{Length: 8192}, {Length: 6 << 30, Hole: true}}
+
+	tests := []struct {
+		name   string
+		fr     replyFrame
+		reqOne bool
+		want   []byte
+	}{
+		{
+			// header; context ID; per extent 32-bit length and flags
+			name:   "compact, one extent",
+			fr:     replyFrame{cookie: testCookie},
+			reqOne: true,
+			want: wire(NBD_STRUCTURED_REPLY_MAGIC, uint16(NBD_REPLY_FLAG_DONE), uint16(NBD_REPLY_TYPE_BLOCK_STATUS), testCookie, uint32(4+8),
+				contextID, uint32(8192), uint32(0)),
+		},
+		{
+			// header; context ID, extent count; per extent 64-bit length
+			// and flags
+			name: "extended",
+			fr:   replyFrame{cookie: testCookie, off: 1 << 20, extended: true},
+			want: wire(NBD_EXTENDED_REPLY_MAGIC, uint16(NBD_REPLY_FLAG_DONE), uint16(NBD_REPLY_TYPE_BLOCK_STATUS_EXT), testCookie, uint64(1<<20), uint64(8+2*16),
+				contextID, uint32(2), uint64(8192), uint64(0), uint64(6<<30), uint64(hole)),
+		},
+		{
+			name:   "extended, one extent",
+			fr:     replyFrame{cookie: testCookie, extended: true},
+			reqOne: true,
+			want: wire(NBD_EXTENDED_REPLY_MAGIC, uint16(NBD_REPLY_FLAG_DONE), uint16(NBD_REPLY_TYPE_BLOCK_STATUS_EXT), testCookie, uint64(0), uint64(8+16),
+				contextID, uint32(1), uint64(8192), uint64(0)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := writeBlockStatus(bufio.NewWriter(&out), tt.fr, contextID, extents, tt.reqOne); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.want) {
+				t.Fatalf("got  %x\nwant %x", out.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitHoles(t *testing.T) {
+	tests := []struct {
+		name string
+		off  uint64
+		buf  []byte
+		want []readChunk
+	}{
+		{
+			name: "aligned",
+			off:  0,
+			buf:  append(make([]byte, 8), 1, 0, 0, 0),
+			want: []readChunk{{start: 0, end: 8, hole: true}, {start: 8, end: 12}},
+		},
+		{
+			// Blocks are aligned to the export, so the first one ends at
+			// the next multiple of the hole size.
+			name: "unaligned",
+			off:  7,
+			buf:  []byte{0, 1, 0, 0, 0, 0, 0, 0, 0, 0},
+			want: []readChunk{{start: 0, end: 1, hole: true}, {start: 1, end: 5}, {start: 5, end: 10, hole: true}},
+		},
+		{
+			name: "all zero",
+			off:  3,
+			buf:  make([]byte, 20),
+			want: []readChunk{{start: 0, end: 20, hole: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitHoles(tt.off, tt.buf, 4)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteStructuredRead(t *testing.T) {
+	const holeSize = 4096
+	// A read from 1000: data up to the first page boundary, a zero page,
+	// then 100 bytes of data.
+	mixed := make([]byte, 3096+4096+100)
+	mixed[0] = 1
+	mixed[len(mixed)-1] = 2
+	zeroes := make([]byte, 5000)
+
+	// offsetData and offsetHole encode an OFFSET_DATA or OFFSET_HOLE chunk:
+	// header, then the offset and either the data or the hole's length.
+	offsetData := func(fr replyFrame, flags uint16, off uint64, data []byte) []byte {
+		return wire(structuredHeader(fr, flags, NBD_REPLY_TYPE_OFFSET_DATA, uint64(8+len(data))), off, data)
+	}
+	offsetHole := func(fr replyFrame, flags uint16, off uint64, length uint32) []byte {
+		return wire(structuredHeader(fr, flags, NBD_REPLY_TYPE_OFFSET_HOLE, 12), off, length)
+	}
+	compact := replyFrame{cookie: testCookie, off: 1000}
+	extended := replyFrame{cookie: testCookie, off: 1000, extended: true}
+
+	tests := []struct {
+		name string
+		fr   replyFrame
+		buf  []byte
+		df   bool
+		want []byte
+	}{
+		{
+			name: "unaligned mixed",
+			fr:   compact,
+			buf:  mixed,
+			want: bytes.Join([][]byte{
+				offsetData(compact, 0, 1000, mixed[:3096]),
+				offsetHole(compact, 0, 4096, 4096),
+				offsetData(compact, NBD_REPLY_FLAG_DONE, 8192, mixed[7192:]),
+			}, nil),
+		},
+		{
+			name: "all zero",
+			fr:   compact,
+			buf:  zeroes,
+			want: offsetHole(compact, NBD_REPLY_FLAG_DONE, 1000, 5000),
+		},
+		{
+			name: "all zero, extended",
+			fr:   extended,
+			buf:  zeroes,
+			want: offsetHole(extended, NBD_REPLY_FLAG_DONE, 1000, 5000),
+		},
+		{
+			name: "don't fragment",
+			fr:   compact,
+			buf:  mixed,
+			df:   true,
+			want: offsetData(compact, NBD_REPLY_FLAG_DONE, 1000, mixed),
+		},
+		{
+			name: "empty",
+			fr:   compact,
+			want: structuredHeader(compact, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_NONE, 0),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := writeStructuredRead(bufio.NewWriter(&out), tt.fr, 1000, tt.buf, holeSize, tt.df); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.want) {
+				t.Fatalf("got  %x\nwant %x", out.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+// structuredHeader encodes a structured or extended reply chunk header.
+func structuredHeader(fr replyFrame, flags, typ uint16, length uint64) []byte {
+	if fr.extended {
+		return wire(NBD_EXTENDED_REPLY_MAGIC, flags, typ, fr.cookie, fr.off, length)
+	}
+	return wire(NBD_STRUCTURED_REPLY_MAGIC, flags, typ, fr.cookie, uint32(length))
+}
@@ -2,18 +2,52 @@ package nbd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"nbds3d/internal/core"
 	"nbds3d/internal/store"
 	"net"
+	"os"
+	"path"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
 type Config struct {
-	Addr        string
+	Addr        string      // TCP listen address, "" for none
+	Socket      string      // Unix socket path, "" for none
+	SocketMode  os.FileMode // permissions of Socket
 	DefaultSize uint64
 	ChunkSize   uint64
 	DataDir     string
+	MaxInflight int
+	MaxPayload  uint64 // largest READ/WRITE accepted; 0 means 32 MiB
+	Description string
+
+	ShutdownTimeout time.Duration
+
+	CacheSize          uint64 // page cache budget across all exports in bytes; 0 for unlimited
+	CacheStatsInterval time.Duration
+	WritebackAge       time.Duration // write back pages dirty for longer; 0 for only on flush
+	DirtyHighWatermark uint64        // per-export dirty bytes that trigger writeback; 0 for no limit
+	DirtyHardLimit     uint64        // per-export dirty bytes at which writes block; 0 for no limit
+	FlushWorkers       int           // parallel page uploads per flush
+	ReadAhead          int           // pages prefetched ahead of sequential reads; 0 to disable
+
+	// StrictChunkSize refuses exports created with another chunk size
+	// instead of serving them with their own.
+	StrictChunkSize bool
+
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	TLSRequired bool
+
+	ACLFile         string
+	ReadOnlyExports []string // path.Match patterns of exports nobody may modify
 
 	S3Bucket    string
 	S3Region    string
@@ -22,16 +56,37 @@ type Config struct {
 	S3SecretKey string
 }
 
-func Run(cfg Config) error {
-	ln, err := net.Listen("tcp", cfg.Addr)
+// shutdownGrace is how long clients get, once told the server is shutting
+// down, to flush and disconnect on their own before their reads are cut off.
+const shutdownGrace = 2 * time.Second
+
+// Run serves NBD on cfg.Addr and cfg.Socket, or on the sockets passed by
+// systemd socket activation, until ctx is done, then shuts down: it stops
+// accepting connections, lets clients react to NBD_ESHUTDOWN for a grace
+// period, cuts off the rest and waits for their exports to be flushed, giving
+// up after cfg.ShutdownTimeout.
+func Run(ctx context.Context, cfg Config) error {
+	if cfg.MaxPayload > math.MaxUint32 {
+		return fmt.Errorf("max payload %d exceeds 4 GiB", cfg.MaxPayload)
+	}
+	if cfg.DirtyHardLimit > 0 && cfg.DirtyHighWatermark > cfg.DirtyHardLimit {
+		return fmt.Errorf("dirty high watermark %d exceeds hard limit %d", cfg.DirtyHighWatermark, cfg.DirtyHardLimit)
+	}
+	for _, pattern := range cfg.ReadOnlyExports {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad read-only export pattern %q", pattern)
+		}
+	}
+
+	lns, err := openListeners(cfg)
 	if err != nil {
 		return err
 	}
-	defer ln.Close()
+	defer closeListeners(lns)
 
 	var st store.Store
 	if cfg.S3Bucket != "" {
-		s3Store, err := store.NewS3Store(context.Background(), store.S3Config{
+		s3Store, err := store.NewS3Store(ctx, store.S3Config{
 			Bucket:          cfg.S3Bucket,
 			Region:          cfg.S3Region,
 			Endpoint:        cfg.S3Endpoint,
@@ -43,30 +98,175 @@ func Run(cfg Config) error {
 		}
 		st = s3Store
 		log.Printf("nbd: listening on %s (defaultSize=%d, chunkSize=%d, storage=s3, bucket=%s)",
-			cfg.Addr, cfg.DefaultSize, cfg.ChunkSize, cfg.S3Bucket)
+			listenerAddrs(lns), cfg.DefaultSize, cfg.ChunkSize, cfg.S3Bucket)
 	} else {
 		st = store.NewFSStore(filepath.Join(cfg.DataDir, "exports"))
 		log.Printf("nbd: listening on %s (defaultSize=%d, chunkSize=%d, storage=filesystem)",
-			cfg.Addr, cfg.DefaultSize, cfg.ChunkSize)
+			listenerAddrs(lns), cfg.DefaultSize, cfg.ChunkSize)
 	}
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Printf("nbd: accept error: %v", err)
-			continue
+	tlsCfg, err := loadTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	var acl *ACL
+	if cfg.ACLFile != "" {
+		if acl, err = LoadACL(cfg.ACLFile); err != nil {
+			return err
 		}
+	}
 
-		go func(c net.Conn) {
-			defer c.Close()
+	reg := core.NewRegistry(st, cfg.ChunkSize, int64(cfg.DefaultSize))
+	reg.StrictPageSize = cfg.StrictChunkSize
+	reg.Cache = core.NewPageCache(int64(cfg.CacheSize))
+	reg.Writeback = core.Writeback{
+		MaxAge:        cfg.WritebackAge,
+		HighWatermark: int64(cfg.DirtyHighWatermark),
+		HardLimit:     int64(cfg.DirtyHardLimit),
+	}
+	reg.FlushWorkers = cfg.FlushWorkers
+	reg.ReadAhead = cfg.ReadAhead
+	if cfg.CacheStatsInterval > 0 {
+		go logCacheStats(ctx, reg.Cache, cfg.CacheStatsInterval)
+	}
 
-			newDevice := func(name string, size uint64) core.Device {
-				return core.NewMemDevice(name, int64(size), cfg.ChunkSize, st)
-			}
+	go func() {
+		<-ctx.Done()
+		closeListeners(lns)
+	}()
+
+	conns := &connSet{conns: make(map[net.Conn]struct{})}
+	var accepting sync.WaitGroup
+	for _, ln := range lns {
+		accepting.Add(1)
+		go func(ln net.Listener) {
+			defer accepting.Done()
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					log.Printf("nbd: accept error: %v", err)
+					continue
+				}
+
+				conns.add(conn)
+				go func(c net.Conn) {
+					defer conns.remove(c)
+					defer c.Close()
 
-			if err := ServeConn(c, cfg, newDevice); err != nil {
-				log.Printf("nbd: connection %s error: %v", c.RemoteAddr(), err)
+					err := ServeConn(ctx, c, cfg, reg, tlsCfg, acl)
+					// Connections cut off at shutdown end with a read timeout.
+					if err != nil && !(ctx.Err() != nil && errors.Is(err, os.ErrDeadlineExceeded)) {
+						log.Printf("nbd: connection %s error: %v", connName(c), err)
+					}
+				}(conn)
 			}
-		}(conn)
+		}(ln)
+	}
+	accepting.Wait()
+
+	// Waiting for clients and flushing what they left behind share the
+	// shutdown timeout. Exports are flushed even if some clients did not
+	// go away in time, as are those whose flush on release failed.
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	err = conns.shutdown(sctx)
+	if cerr := reg.Close(sctx); cerr != nil {
+		err = errors.Join(err, cerr)
+	}
+	logCacheStatsOnce(reg.Cache)
+	return err
+}
+
+func logCacheStats(ctx context.Context, cache *core.PageCache, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			logCacheStatsOnce(cache)
+		}
+	}
+}
+
+func logCacheStatsOnce(cache *core.PageCache) {
+	s := cache.Stats()
+	log.Printf("nbd: page cache: %d/%d bytes in %d pages, hits=%d misses=%d evictions=%d writebacks=%d",
+		s.Used, s.Limit, s.Pages, s.Hits, s.Misses, s.Evictions, s.Writebacks)
+}
+
+// connName identifies c in logs. Clients on a Unix socket are usually
+// unnamed, so those are shown by the socket they connected to.
+func connName(c net.Conn) string {
+	if addr := c.RemoteAddr(); addr != nil && addr.String() != "" && addr.String() != "@" {
+		return addr.String()
+	}
+	return c.LocalAddr().Network() + ":" + c.LocalAddr().String()
+}
+
+// connSet tracks open connections so shutdown can wait for them.
+type connSet struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func (s *connSet) add(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+}
+
+func (s *connSet) remove(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	s.wg.Done()
+}
+
+func (s *connSet) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// shutdown waits for every connection to finish, until ctx is done. After
+// shutdownGrace the remaining ones stop reading, which ends their session
+// once requests already received are answered and their export is flushed.
+func (s *connSet) shutdown(ctx context.Context) error {
+	log.Printf("nbd: shutting down, %d connection(s) open", s.count())
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Printf("nbd: shutdown complete")
+		return nil
+	case <-time.After(shutdownGrace):
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	for c := range s.conns {
+		c.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-done:
+		log.Printf("nbd: shutdown complete")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("shutdown timed out with %d connection(s) open", s.count())
 	}
 }
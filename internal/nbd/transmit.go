@@ -2,13 +2,22 @@ package nbd
 
 import (
 	"bufio"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
+	"sync"
 
 	"nbds3d/internal/core"
 )
 
+// maxBlockStatusPages is the most pages a single NBD_CMD_BLOCK_STATUS reply
+// describes. Extents are page granular, so this bounds both the work and the
+// number of extents, whatever the page size.
+const maxBlockStatusPages = 1 << 20
+
 func writeSimpleReply(w *bufio.Writer, errCode uint32, cookie uint64, payload []byte) error {
 	if err := writeU32(w, NBD_SIMPLE_REPLY_MAGIC); err != nil {
 		return err
@@ -27,99 +36,356 @@ func writeSimpleReply(w *bufio.Writer, errCode uint32, cookie uint64, payload []
 	return w.Flush()
 }
 
-func transmit(br *bufio.Reader, bw *bufio.Writer, dev core.Device) error {
+// writeThrough honours NBD_CMD_FLAG_FUA by persisting the range a request
+// touched before it is acknowledged.
+func writeThrough(dev core.Device, cmdFlags uint16, off, length uint64) error {
+	if cmdFlags&NBD_CMD_FLAG_FUA == 0 {
+		return nil
+	}
+	return dev.FlushRange(int64(off), int64(length))
+}
+
+// request is a single transmission-phase command as read off the wire.
+type request struct {
+	flags  uint16
+	typ    uint16
+	cookie uint64
+	off    uint64
+	length uint64
+	data   []byte // NBD_CMD_WRITE payload
+}
+
+func (r *request) modifies() bool {
+	switch r.typ {
+	case NBD_CMD_WRITE, NBD_CMD_TRIM, NBD_CMD_WRITE_ZEROES:
+		return true
+	}
+	return false
+}
+
+// transmitter runs the transmission phase of one connection. Requests are
+// read in order and handed to up to maxInflight goroutines, so a slow page
+// fetch only holds up its own request. Replies may therefore go out in any
+// order; the client matches them by cookie. Each reply is written whole
+// under wmu.
+type transmitter struct {
+	ctx  context.Context // done once the server is shutting down
+	bw   *bufio.Writer
+	dev  core.Device
+	sess *session
+	sem  chan struct{}
+
+	wmu sync.Mutex
+
+	errMu sync.Mutex
+	werr  error
+
+	// barrier orders FLUSH after the writes received before it: modifying
+	// requests hold it shared while they run, and FLUSH takes it exclusively
+	// before flushing the device.
+	barrier sync.RWMutex
+	wg      sync.WaitGroup
+}
+
+func transmit(ctx context.Context, br *bufio.Reader, bw *bufio.Writer, dev core.Device, sess *session, maxInflight int) error {
+	if maxInflight < 1 {
+		maxInflight = 1
+	}
+	t := &transmitter{
+		ctx:  ctx,
+		bw:   bw,
+		dev:  dev,
+		sess: sess,
+		sem:  make(chan struct{}, maxInflight),
+	}
+
+	err := t.readLoop(br)
+	t.wg.Wait()
+	if err == nil {
+		err = t.writeErr()
+	}
+	return err
+}
+
+func (t *transmitter) readLoop(br *bufio.Reader) error {
 	for {
-		magic, err := readU32(br)
-		if err != nil {
+		if err := t.writeErr(); err != nil {
 			return err
 		}
-		if magic != NBD_REQUEST_MAGIC {
-			return errors.New("bad request magic")
-		}
 
-		_, err = readU16(br) // cmdFlags - not currently used
+		req, err := readRequest(br, t.sess)
 		if err != nil {
 			return err
 		}
-		typ, err := readU16(br)
-		if err != nil {
-			return err
+		if req.typ == NBD_CMD_DISC {
+			return nil
 		}
-		cookie, err := readU64(br)
-		if err != nil {
-			return err
+
+		t.sem <- struct{}{}
+		if req.modifies() {
+			t.barrier.RLock()
 		}
-		off, err := readU64(br)
-		if err != nil {
-			return err
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			defer func() { <-t.sem }()
+			if req.modifies() {
+				defer t.barrier.RUnlock()
+			}
+			if err := t.handle(req); err != nil {
+				t.setWriteErr(err)
+			}
+		}()
+	}
+}
+
+// readRequest reads one request header, in the 32-byte extended form once
+// extended headers are negotiated, plus any write payload. Payloads over the
+// session's limit are skipped instead of buffered; handle then rejects the
+// request.
+func readRequest(br *bufio.Reader, sess *session) (*request, error) {
+	extended := sess.extendedHeaders
+	magic, err := readU32(br)
+	if err != nil {
+		return nil, err
+	}
+	wantMagic := uint32(NBD_REQUEST_MAGIC)
+	if extended {
+		wantMagic = NBD_REQUEST_EXT_MAGIC
+	}
+	if magic != wantMagic {
+		return nil, errors.New("bad request magic")
+	}
+
+	req := &request{}
+	if req.flags, err = readU16(br); err != nil {
+		return nil, err
+	}
+	if req.typ, err = readU16(br); err != nil {
+		return nil, err
+	}
+	if req.cookie, err = readU64(br); err != nil {
+		return nil, err
+	}
+	if req.off, err = readU64(br); err != nil {
+		return nil, err
+	}
+	if extended {
+		if req.length, err = readU64(br); err != nil {
+			return nil, err
 		}
+	} else {
 		lengthU32, err := readU32(br)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		length := int(lengthU32)
+		req.length = uint64(lengthU32)
+	}
 
-		switch typ {
-		case NBD_CMD_READ:
-			if int64(off)+int64(length) > dev.Size() {
-				if err := writeSimpleReply(bw, NBD_EINVAL, cookie, nil); err != nil {
-					return err
-				}
-				continue
-			}
-			buf := make([]byte, length)
-			if _, err := dev.ReadAt(buf, int64(off)); err != nil {
-				if err := writeSimpleReply(bw, NBD_EIO, cookie, nil); err != nil {
-					return err
-				}
-				continue
+	if req.flags&NBD_CMD_FLAG_PAYLOAD_LEN != 0 && req.typ != NBD_CMD_WRITE {
+		return nil, fmt.Errorf("unsupported payload on command %d", req.typ)
+	}
+	if req.typ == NBD_CMD_WRITE {
+		if req.length > sess.maxPayload {
+			// A compact header cannot announce more than 4 GiB, which we
+			// can afford to read past; anything bigger ends the session.
+			if req.length > math.MaxUint32 {
+				return nil, fmt.Errorf("write payload of %d bytes exceeds limit", req.length)
 			}
-			if err := writeSimpleReply(bw, 0, cookie, buf); err != nil {
-				return err
+			if _, err := io.CopyN(io.Discard, br, int64(req.length)); err != nil {
+				return nil, err
 			}
+			return req, nil
+		}
+		req.data = make([]byte, req.length)
+		if _, err := io.ReadFull(br, req.data); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
 
-		case NBD_CMD_WRITE:
-			buf := make([]byte, length)
-			if _, err := io.ReadFull(br, buf); err != nil {
-				return err
-			}
-			if int64(off)+int64(length) > dev.Size() {
-				if err := writeSimpleReply(bw, NBD_ENOSPC, cookie, nil); err != nil {
-					return err
-				}
-				continue
-			}
-			if _, err := dev.WriteAt(buf, int64(off)); err != nil {
-				if err := writeSimpleReply(bw, NBD_EIO, cookie, nil); err != nil {
-					return err
-				}
-				continue
-			}
-			if err := writeSimpleReply(bw, 0, cookie, nil); err != nil {
-				return err
-			}
+func (t *transmitter) writeErr() error {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+	return t.werr
+}
 
-		case NBD_CMD_FLUSH:
-			log.Printf("nbd: received flush command")
-			if err := dev.Flush(); err != nil {
-				log.Printf("nbd: flush error: %v", err)
-				if err := writeSimpleReply(bw, NBD_EIO, cookie, nil); err != nil {
-					return err
-				}
-				continue
-			}
-			if err := writeSimpleReply(bw, 0, cookie, nil); err != nil {
-				return err
-			}
-			log.Printf("nbd: flush completed successfully")
+func (t *transmitter) setWriteErr(err error) {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+	if t.werr == nil {
+		t.werr = err
+	}
+}
 
-		case NBD_CMD_DISC:
-			return nil
+func (t *transmitter) frame(req *request) replyFrame {
+	return replyFrame{cookie: req.cookie, off: req.off, extended: t.sess.extendedHeaders}
+}
+
+// ack completes a request that returns no data. Extended headers have no
+// simple replies, so there it is an empty NONE chunk.
+func (t *transmitter) ack(req *request) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if t.sess.extendedHeaders {
+		return writeNoneChunk(t.bw, t.frame(req))
+	}
+	return writeSimpleReply(t.bw, 0, req.cookie, nil)
+}
+
+// fail reports errCode for req. Reads and block status requests are
+// answered with chunks once structured replies are negotiated, and with
+// extended headers everything is, so the error goes out as an error chunk
+// carrying msg; otherwise it is a simple reply.
+func (t *transmitter) fail(req *request, errCode uint32, msg string) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	chunked := t.sess.extendedHeaders ||
+		(t.sess.structuredReplies && (req.typ == NBD_CMD_READ || req.typ == NBD_CMD_BLOCK_STATUS))
+	if chunked {
+		return writeErrorChunk(t.bw, t.frame(req), errCode, msg)
+	}
+	return writeSimpleReply(t.bw, errCode, req.cookie, nil)
+}
 
-		default:
-			if err := writeSimpleReply(bw, NBD_EINVAL, cookie, nil); err != nil {
-				return err
+func (t *transmitter) handle(req *request) error {
+	dev := t.dev
+	off, length := req.off, req.length
+	end := off + length
+	inRange := end >= off && end <= uint64(dev.Size())
+	tooBig := length > t.sess.maxPayload
+
+	// A client told to shut down should flush and disconnect, so FLUSH is
+	// still served.
+	if t.ctx.Err() != nil && req.typ != NBD_CMD_FLUSH {
+		return t.fail(req, NBD_ESHUTDOWN, "server shutting down")
+	}
+	if req.modifies() && t.sess.readOnly {
+		return t.fail(req, NBD_EPERM, "export is read-only")
+	}
+
+	switch req.typ {
+	case NBD_CMD_READ:
+		if tooBig {
+			return t.fail(req, NBD_EOVERFLOW, "read too large")
+		}
+		if !inRange {
+			return t.fail(req, NBD_EINVAL, "read beyond end of export")
+		}
+		buf := make([]byte, length)
+		if _, err := dev.ReadAt(buf, int64(off)); err != nil {
+			log.Printf("nbd: read error: %v", err)
+			return t.fail(req, NBD_EIO, "read failed")
+		}
+		t.wmu.Lock()
+		defer t.wmu.Unlock()
+		if t.sess.structuredReplies {
+			df := req.flags&NBD_CMD_FLAG_DF != 0
+			return writeStructuredRead(t.bw, t.frame(req), off, buf, t.sess.holeSize, df)
+		}
+		return writeSimpleReply(t.bw, 0, req.cookie, buf)
+
+	case NBD_CMD_WRITE:
+		if tooBig {
+			return t.fail(req, NBD_EOVERFLOW, "write too large")
+		}
+		if !inRange {
+			return t.fail(req, NBD_ENOSPC, "write beyond end of export")
+		}
+		_, err := dev.WriteAt(req.data, int64(off))
+		if err == nil {
+			err = writeThrough(dev, req.flags, off, length)
+		}
+		if err != nil {
+			log.Printf("nbd: write error: %v", err)
+			return t.fail(req, NBD_EIO, "write failed")
+		}
+		return t.ack(req)
+
+	case NBD_CMD_FLUSH:
+		t.barrier.Lock()
+		t.barrier.Unlock()
+
+		log.Printf("nbd: received flush command")
+		if err := dev.Flush(); err != nil {
+			log.Printf("nbd: flush error: %v", err)
+			return t.fail(req, NBD_EIO, "flush failed")
+		}
+		if err := t.ack(req); err != nil {
+			return err
+		}
+		log.Printf("nbd: flush completed successfully")
+		return nil
+
+	case NBD_CMD_TRIM:
+		if !inRange {
+			return t.fail(req, NBD_EINVAL, "trim beyond end of export")
+		}
+		err := dev.Trim(int64(off), int64(length))
+		if err == nil {
+			err = writeThrough(dev, req.flags, off, length)
+		}
+		if err != nil {
+			log.Printf("nbd: trim error: %v", err)
+			return t.fail(req, NBD_EIO, "trim failed")
+		}
+		return t.ack(req)
+
+	case NBD_CMD_WRITE_ZEROES:
+		if !inRange {
+			return t.fail(req, NBD_ENOSPC, "write beyond end of export")
+		}
+		noHole := req.flags&NBD_CMD_FLAG_NO_HOLE != 0
+		fast := req.flags&NBD_CMD_FLAG_FAST_ZERO != 0
+		err := dev.WriteZeroes(int64(off), int64(length), noHole, fast)
+		if err == nil {
+			err = writeThrough(dev, req.flags, off, length)
+		}
+		if err != nil {
+			if errors.Is(err, core.ErrNotFast) {
+				return t.fail(req, NBD_ENOTSUP, "fast zero not possible")
 			}
+			log.Printf("nbd: write zeroes error: %v", err)
+			return t.fail(req, NBD_EIO, "write zeroes failed")
+		}
+		return t.ack(req)
+
+	case NBD_CMD_CACHE:
+		if tooBig {
+			return t.fail(req, NBD_EOVERFLOW, "cache request too large")
 		}
+		if !inRange {
+			return t.fail(req, NBD_EINVAL, "cache beyond end of export")
+		}
+		if err := dev.Prefetch(int64(off), int64(length)); err != nil {
+			log.Printf("nbd: cache error: %v", err)
+			return t.fail(req, NBD_EIO, "cache failed")
+		}
+		return t.ack(req)
+
+	case NBD_CMD_BLOCK_STATUS:
+		if !t.sess.allocationContext {
+			return t.fail(req, NBD_EINVAL, "no metadata context negotiated")
+		}
+		if length == 0 || !inRange {
+			return t.fail(req, NBD_EINVAL, "invalid range")
+		}
+		// The reply may cover less than was asked for.
+		if limit := maxBlockStatusPages * dev.PageSize(); length > limit {
+			length = limit
+		}
+		extents, err := dev.BlockStatus(int64(off), int64(length))
+		if err != nil {
+			log.Printf("nbd: block status error: %v", err)
+			return t.fail(req, NBD_EIO, "block status failed")
+		}
+		reqOne := req.flags&NBD_CMD_FLAG_REQ_ONE != 0
+		t.wmu.Lock()
+		defer t.wmu.Unlock()
+		return writeBlockStatus(t.bw, t.frame(req), allocationContextID, extents, reqOne)
+
+	default:
+		return t.fail(req, NBD_EINVAL, "unknown command")
 	}
 }
@@ -0,0 +1,234 @@
+package nbd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+
+	"nbds3d/internal/core"
+)
+
+// wire encodes fields big-endian, one after the other, as the protocol lays
+// them out: uint16, uint32 and uint64 fields take 2, 4 and 8 bytes and byte
+// slices are copied as they are.
+func wire(fields ...any) []byte {
+	var b bytes.Buffer
+	for _, f := range fields {
+		switch f := f.(type) {
+		case []byte:
+			b.Write(f)
+		case uint16, uint32, uint64:
+			binary.Write(&b, be, f)
+		default:
+			panic(fmt.Sprintf("wire: unsupported field type %T", f))
+		}
+	}
+	return b.Bytes()
+}
+
+func TestReadRequest(t *testing.T) {
+	const cookie = uint64(0x0102030405060708)
+	payload := []byte("hello")
+
+	tests := []struct {
+		name     string
+		extended bool
+		in       []byte
+		want     *request
+		wantErr  bool
+	}{
+		{
+			// magic, flags, type, cookie, offset, 32-bit length
+			name: "compact read",
+			in:   wire(NBD_REQUEST_MAGIC, uint16(NBD_CMD_FLAG_FUA), uint16(NBD_CMD_READ), cookie, uint64(4096), uint32(512)),
+			want: &request{flags: NBD_CMD_FLAG_FUA, typ: NBD_CMD_READ, cookie: cookie, off: 4096, length: 512},
+		},
+		{
+			name: "compact write",
+			in:   wire(NBD_REQUEST_MAGIC, uint16(0), uint16(NBD_CMD_WRITE), cookie, uint64(1), uint32(len(payload)), payload),
+			want: &request{typ: NBD_CMD_WRITE, cookie: cookie, off: 1, length: uint64(len(payload)), data: payload},
+		},
+		{
+			// magic, flags, type, cookie, offset, 64-bit length
+			name:     "extended trim beyond 4 GiB",
+			extended: true,
+			in:       wire(NBD_REQUEST_EXT_MAGIC, uint16(0), uint16(NBD_CMD_TRIM), cookie, uint64(1<<40), uint64(1<<33)),
+			want:     &request{typ: NBD_CMD_TRIM, cookie: cookie, off: 1 << 40, length: 1 << 33},
+		},
+		{
+			name:     "extended write with payload length",
+			extended: true,
+			in:       wire(NBD_REQUEST_EXT_MAGIC, uint16(NBD_CMD_FLAG_PAYLOAD_LEN), uint16(NBD_CMD_WRITE), cookie, uint64(0), uint64(len(payload)), payload),
+			want:     &request{flags: NBD_CMD_FLAG_PAYLOAD_LEN, typ: NBD_CMD_WRITE, cookie: cookie, length: uint64(len(payload)), data: payload},
+		},
+		{
+			name:     "payload length on a command without payload",
+			extended: true,
+			in:       wire(NBD_REQUEST_EXT_MAGIC, uint16(NBD_CMD_FLAG_PAYLOAD_LEN), uint16(NBD_CMD_BLOCK_STATUS), cookie, uint64(0), uint64(8)),
+			wantErr:  true,
+		},
+		{
+			name:     "compact header after extended headers",
+			extended: true,
+			in:       wire(NBD_REQUEST_MAGIC, uint16(0), uint16(NBD_CMD_READ), cookie, uint64(0), uint32(512)),
+			wantErr:  true,
+		},
+		{
+			name:    "extended header without extended headers",
+			in:      wire(NBD_REQUEST_EXT_MAGIC, uint16(0), uint16(NBD_CMD_READ), cookie, uint64(0), uint64(512)),
+			wantErr: true,
+		},
+		{
+			name:    "short payload",
+			in:      wire(NBD_REQUEST_MAGIC, uint16(0), uint16(NBD_CMD_WRITE), cookie, uint64(0), uint32(8), payload),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := &session{extendedHeaders: tt.extended, structuredReplies: tt.extended, maxPayload: 1 << 20}
+			got, err := readRequest(bufio.NewReader(bytes.NewReader(tt.in)), sess)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// recordDevice is a device that records which of its methods were called.
+type recordDevice struct {
+	size int64
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (d *recordDevice) record(name string) {
+	d.mu.Lock()
+	d.calls = append(d.calls, name)
+	d.mu.Unlock()
+}
+
+func (d *recordDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.record("ReadAt")
+	return len(p), nil
+}
+
+func (d *recordDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.record("WriteAt")
+	return len(p), nil
+}
+
+func (d *recordDevice) Flush() error                       { d.record("Flush"); return nil }
+func (d *recordDevice) FlushRange(off, length int64) error { d.record("FlushRange"); return nil }
+func (d *recordDevice) Size() int64                        { return d.size }
+func (d *recordDevice) PageSize() uint64                   { return 4096 }
+func (d *recordDevice) Close() error                       { return nil }
+func (d *recordDevice) Trim(off, length int64) error       { d.record("Trim"); return nil }
+func (d *recordDevice) Prefetch(off, length int64) error   { d.record("Prefetch"); return nil }
+
+func (d *recordDevice) BlockStatus(off, length int64) ([]core.Extent, error) {
+	d.record("BlockStatus")
+	return []core.Extent{{Length: length}}, nil
+}
+
+func (d *recordDevice) WriteZeroes(off, length int64, noHole, fast bool) error {
+	d.record("WriteZeroes")
+	return nil
+}
+
+// runTransmit serves the requests in in, followed by NBD_CMD_DISC, one at a
+// time so that the replies come back in order, and returns the replies.
+func runTransmit(t *testing.T, sess *session, dev core.Device, in []byte) []byte {
+	t.Helper()
+	in = append(in, wire(NBD_REQUEST_MAGIC, uint16(0), uint16(NBD_CMD_DISC), uint64(0), uint64(0), uint32(0))...)
+	var out bytes.Buffer
+	bw := bufio.NewWriter(&out)
+	if err := transmit(context.Background(), bufio.NewReader(bytes.NewReader(in)), bw, dev, sess, 1); err != nil {
+		t.Fatal(err)
+	}
+	bw.Flush()
+	return out.Bytes()
+}
+
+// simpleReply encodes a simple reply without payload: magic, error, cookie.
+func simpleReply(errCode uint32, cookie uint64) []byte {
+	return wire(NBD_SIMPLE_REPLY_MAGIC, errCode, cookie)
+}
+
+// TestOversizedWriteIsSkipped sends a compact WRITE over the payload limit
+// followed by a FLUSH: the write's payload must be read past, not served,
+// and the FLUSH must still be parsed.
+func TestOversizedWriteIsSkipped(t *testing.T) {
+	const maxPayload = 64
+	dev := &recordDevice{size: 1 << 20}
+	sess := &session{maxPayload: maxPayload}
+	in := bytes.Join([][]byte{
+		wire(NBD_REQUEST_MAGIC, uint16(0), uint16(NBD_CMD_WRITE), uint64(1), uint64(0), uint32(maxPayload+1)),
+		bytes.Repeat([]byte{0xff}, maxPayload+1),
+		wire(NBD_REQUEST_MAGIC, uint16(0), uint16(NBD_CMD_FLUSH), uint64(2), uint64(0), uint32(0)),
+	}, nil)
+
+	got := runTransmit(t, sess, dev, in)
+	want := append(simpleReply(NBD_EOVERFLOW, 1), simpleReply(0, 2)...)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got  %x\nwant %x", got, want)
+	}
+	if !reflect.DeepEqual(dev.calls, []string{"Flush"}) {
+		t.Fatalf("device calls %v, want only the flush", dev.calls)
+	}
+}
+
+// TestRangeOverflow sends requests whose offset plus length wraps around
+// and checks they are refused without reaching the device.
+func TestRangeOverflow(t *testing.T) {
+	const (
+		off    = math.MaxUint64 - 10
+		length = 100
+	)
+	tests := []struct {
+		name    string
+		typ     uint16
+		errCode uint32
+	}{
+		{"read", NBD_CMD_READ, NBD_EINVAL},
+		{"write", NBD_CMD_WRITE, NBD_ENOSPC},
+		{"trim", NBD_CMD_TRIM, NBD_EINVAL},
+		{"write zeroes", NBD_CMD_WRITE_ZEROES, NBD_ENOSPC},
+		{"cache", NBD_CMD_CACHE, NBD_EINVAL},
+		{"block status", NBD_CMD_BLOCK_STATUS, NBD_EINVAL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := &recordDevice{size: 1 << 20}
+			sess := &session{maxPayload: 1 << 10, allocationContext: true}
+			in := wire(NBD_REQUEST_MAGIC, uint16(0), tt.typ, uint64(1), uint64(off), uint32(length))
+			if tt.typ == NBD_CMD_WRITE {
+				in = append(in, make([]byte, length)...)
+			}
+
+			got := runTransmit(t, sess, dev, in)
+			if want := simpleReply(tt.errCode, 1); !bytes.Equal(got, want) {
+				t.Fatalf("got  %x\nwant %x", got, want)
+			}
+			if len(dev.calls) > 0 {
+				t.Fatalf("request reached the device: %v", dev.calls)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -60,3 +61,85 @@ func (s *FSStore) FlushExport(ctx context.Context, export string) error {
 	// For filesystem backend, rename is atomic — nothing extra needed.
 	return nil
 }
+
+func (s *FSStore) ListPages(ctx context.Context, export string) ([]uint64, error) {
+	entries, err := os.ReadDir(filepath.Join(s.rootDir, export))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var pages []uint64
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if idx, ok := parsePageName(e.Name()); ok {
+			pages = append(pages, idx)
+		}
+	}
+	return pages, nil
+}
+
+func (s *FSStore) DeletePages(ctx context.Context, export string, indices []uint64) error {
+	for _, idx := range indices {
+		if err := os.Remove(s.pagePath(export, idx)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FSStore) ListExports(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.rootDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var exports []string
+	for _, e := range entries {
+		if e.IsDir() {
+			exports = append(exports, e.Name())
+		}
+	}
+	return exports, nil
+}
+
+func (s *FSStore) ReadMeta(ctx context.Context, export string) (*ExportMeta, error) {
+	raw, err := os.ReadFile(filepath.Join(s.rootDir, export, metaName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var meta ExportMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, fmt.Errorf("export %s: bad %s: %w", export, metaName, err)
+	}
+	return &meta, nil
+}
+
+func (s *FSStore) WriteMeta(ctx context.Context, export string, meta *ExportMeta) error {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(s.rootDir, export)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, metaName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -3,9 +3,12 @@ package store
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"path"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -14,6 +17,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// s3DeleteBatch is the most keys DeleteObjects accepts in one call.
+const s3DeleteBatch = 1000
+
 type S3Store struct {
 	client *s3.Client
 	bucket string
@@ -61,8 +67,16 @@ func NewS3Store(ctx context.Context, cfg S3Config) (*S3Store, error) {
 	}, nil
 }
 
+func (s *S3Store) exportPrefix(export string) string {
+	return fmt.Sprintf("exports/%s/", export)
+}
+
 func (s *S3Store) pageKey(export string, index uint64) string {
-	return fmt.Sprintf("exports/%s/page-%08d.bin", export, index)
+	return fmt.Sprintf("%spage-%08d.bin", s.exportPrefix(export), index)
+}
+
+func (s *S3Store) metaKey(export string) string {
+	return s.exportPrefix(export) + metaName
 }
 
 func (s *S3Store) ReadPage(ctx context.Context, addr PageAddress) ([]byte, error) {
@@ -108,3 +122,120 @@ func (s *S3Store) WritePage(ctx context.Context, addr PageAddress, data []byte)
 func (s *S3Store) FlushExport(ctx context.Context, export string) error {
 	return nil
 }
+
+func (s *S3Store) ListPages(ctx context.Context, export string) ([]uint64, error) {
+	prefix := s.exportPrefix(export)
+
+	var pages []uint64
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix + "page-"),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %w", prefix, err)
+		}
+		for _, obj := range out.Contents {
+			if idx, ok := parsePageName(path.Base(aws.ToString(obj.Key))); ok {
+				pages = append(pages, idx)
+			}
+		}
+	}
+	return pages, nil
+}
+
+func (s *S3Store) DeletePages(ctx context.Context, export string, indices []uint64) error {
+	for len(indices) > 0 {
+		n := len(indices)
+		if n > s3DeleteBatch {
+			n = s3DeleteBatch
+		}
+
+		objects := make([]types.ObjectIdentifier, 0, n)
+		for _, idx := range indices[:n] {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(s.pageKey(export, idx))})
+		}
+		out, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("s3 delete %s: %w", s.exportPrefix(export), err)
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("s3 delete %s: %s (%d of %d keys failed)",
+				aws.ToString(e.Key), aws.ToString(e.Message), len(out.Errors), n)
+		}
+
+		indices = indices[n:]
+	}
+	return nil
+}
+
+func (s *S3Store) ListExports(ctx context.Context) ([]string, error) {
+	const prefix = "exports/"
+
+	var exports []string
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %w", prefix, err)
+		}
+		for _, cp := range out.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(cp.Prefix), prefix), "/")
+			if name != "" {
+				exports = append(exports, name)
+			}
+		}
+	}
+	return exports, nil
+}
+
+func (s *S3Store) ReadMeta(ctx context.Context, export string) (*ExportMeta, error) {
+	key := s.metaKey(export)
+
+	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("s3 get %s: %w", key, err)
+	}
+	defer result.Body.Close()
+
+	var meta ExportMeta
+	if err := json.NewDecoder(result.Body).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("s3 read %s: %w", key, err)
+	}
+	return &meta, nil
+}
+
+func (s *S3Store) WriteMeta(ctx context.Context, export string, meta *ExportMeta) error {
+	key := s.metaKey(export)
+
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(raw),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("s3 put %s: %w", key, err)
+	}
+	return nil
+}
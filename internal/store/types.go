@@ -1,6 +1,11 @@
 package store
 
-import "context"
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type PageAddress struct {
 	Export string // export name
@@ -8,6 +13,14 @@ type PageAddress struct {
 	Size   uint64 // page size in bytes
 }
 
+// ExportMeta describes an export. It is stored next to the export's pages
+// when the export is created.
+type ExportMeta struct {
+	Size      int64     `json:"size"`
+	ChunkSize uint64    `json:"chunk_size"`
+	Created   time.Time `json:"created"`
+}
+
 type FSStore struct {
 	rootDir string
 }
@@ -16,4 +29,25 @@ type Store interface {
 	ReadPage(ctx context.Context, addr PageAddress) ([]byte, error)
 	WritePage(ctx context.Context, addr PageAddress, data []byte) error
 	FlushExport(ctx context.Context, export string) error
+	ListPages(ctx context.Context, export string) ([]uint64, error)
+	DeletePages(ctx context.Context, export string, indices []uint64) error
+	ListExports(ctx context.Context) ([]string, error)
+	// ReadMeta returns nil, and no error, for an export without metadata.
+	ReadMeta(ctx context.Context, export string) (*ExportMeta, error)
+	WriteMeta(ctx context.Context, export string, meta *ExportMeta) error
+}
+
+// metaName is the name of the metadata object within an export.
+const metaName = "meta.json"
+
+// parsePageName extracts the page index from a "page-XXXXXXXX.bin" name.
+func parsePageName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, "page-") || !strings.HasSuffix(name, ".bin") {
+		return 0, false
+	}
+	idx, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "page-"), ".bin"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return idx, true
 }